@@ -0,0 +1,1148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Serves a request through the API's routes and returns the response
+func serve(store ProductStore, method, url, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	routes(store).ServeHTTP(w, r)
+	return w
+}
+
+// Stores products named names, normalized as creates would
+func seed(store *fakeStore, names ...string) []Product {
+	var products []Product
+	for i, name := range names {
+		p := Product{Name: name, Price: float64(10 * (i + 1))}
+		normalizeProduct(&p)
+		if err := store.Insert(&p); err != nil {
+			panic(err)
+		}
+		products = append(products, p)
+	}
+	return products
+}
+
+// Decodes the JSON body of w into v, failing the test if it isn't JSON
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("body %q is not JSON: %s", w.Body.String(), err)
+	}
+}
+
+func TestCreateProduct(t *testing.T) {
+	store := newFakeStore()
+
+	w := serve(store, "POST", "/products", `{"name":"Lamp","price":12.5}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want 201: %s", w.Code, w.Body)
+	}
+
+	location := w.Header().Get("Location")
+	if !regexp.MustCompile(`^/products/[0-9a-f]{24}$`).MatchString(location) {
+		t.Fatalf("Location = %q, want /products/<hex id>", location)
+	}
+
+	var created Product
+	decode(t, w, &created)
+	if location != "/products/"+created.ID.Hex() {
+		t.Errorf("body id %s doesn't match Location %s", created.ID.Hex(), location)
+	}
+	if created.Name != "Lamp" || created.Price != 12.5 || created.Number != 1 {
+		t.Errorf("created = %+v", created)
+	}
+	if _, ok := store.products[created.ID]; !ok {
+		t.Errorf("product was not stored")
+	}
+}
+
+func TestCreateProductIncorrectBody(t *testing.T) {
+	w := serve(newFakeStore(), "POST", "/products", `{"name":`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
+
+func TestGetProductById(t *testing.T) {
+	store := newFakeStore()
+	lamp := seed(store, "Lamp")[0]
+
+	w := serve(store, "GET", "/products/"+lamp.ID.Hex(), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var got Product
+	decode(t, w, &got)
+	if got.ID != lamp.ID || got.Name != "Lamp" {
+		t.Errorf("got %+v, want the lamp", got)
+	}
+	if store.products[lamp.ID].Views != 1 {
+		t.Errorf("view was not counted")
+	}
+}
+
+func TestGetProductByIdErrors(t *testing.T) {
+	store := newFakeStore()
+
+	if w := serve(store, "GET", "/products/"+bson.NewObjectId().Hex(), ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown id: status = %d, want 404", w.Code)
+	}
+	if w := serve(store, "GET", "/products/not-an-id", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid id: status = %d, want 400", w.Code)
+	}
+}
+
+func TestListProducts(t *testing.T) {
+	store := newFakeStore()
+	seed(store, "Red lamp", "Blue lamp", "Chair")
+
+	w := serve(store, "GET", "/products?q=lamp", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if total := w.Header().Get("X-Total-Count"); total != "2" {
+		t.Errorf("X-Total-Count = %s, want 2", total)
+	}
+
+	var products []map[string]interface{}
+	decode(t, w, &products)
+	if len(products) != 2 {
+		t.Fatalf("got %d products, want 2", len(products))
+	}
+	// Lists are summaries by default
+	for _, p := range products {
+		if _, ok := p["number"]; ok {
+			t.Errorf("summary has number: %v", p)
+		}
+	}
+
+	w = serve(store, "GET", "/products?q=lamp&full=true", "")
+	decode(t, w, &products)
+	if _, ok := products[0]["number"]; !ok {
+		t.Errorf("full product has no number: %v", products[0])
+	}
+}
+
+func TestUpdateProduct(t *testing.T) {
+	store := newFakeStore()
+	lamp := seed(store, "Lamp")[0]
+
+	w := serve(store, "PUT", "/products/"+lamp.ID.Hex(), `{"name":"Desk lamp","price":20}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204: %s", w.Code, w.Body)
+	}
+	if got := store.products[lamp.ID]; got.Name != "Desk lamp" || got.Price != 20 {
+		t.Errorf("stored %+v after update", got)
+	}
+
+	w = serve(store, "PUT", "/products/"+bson.NewObjectId().Hex(), `{"name":"Sofa","price":1}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown id: status = %d, want 404", w.Code)
+	}
+	w = serve(store, "PUT", "/products/"+lamp.ID.Hex(), `{}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("empty update: status = %d, want 400", w.Code)
+	}
+}
+
+func TestDeleteProduct(t *testing.T) {
+	store := newFakeStore()
+	lamp := seed(store, "Lamp")[0]
+
+	if w := serve(store, "DELETE", "/products/"+lamp.ID.Hex(), ""); w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", w.Code)
+	}
+	if _, ok := store.products[lamp.ID]; ok {
+		t.Errorf("product is still stored")
+	}
+	if w := serve(store, "DELETE", "/products/"+lamp.ID.Hex(), ""); w.Code != http.StatusNotFound {
+		t.Errorf("second delete: status = %d, want 404", w.Code)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	store := newFakeStore()
+
+	w := serve(store, "GET", "/health", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"ok"`) {
+		t.Errorf("healthy: %d %s", w.Code, w.Body)
+	}
+
+	store.err = errDup
+	w = serve(store, "GET", "/health", "")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"unavailable"`) {
+		t.Errorf("unreachable: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestDatabaseErrorsAnswer500(t *testing.T) {
+	store := newFakeStore()
+	store.err = errDup
+
+	if w := serve(store, "GET", "/products", ""); w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+}
+
+func TestErrorWithJSONRoundTrips(t *testing.T) {
+	for _, message := range []string{`plain`, `has "quotes"`, `back\slash`, "new\nline", `<tag> & </tag>`, "ünïcode"} {
+		w := httptest.NewRecorder()
+		ErrorWithJSON(w, message, http.StatusTeapot)
+
+		if w.Code != http.StatusTeapot {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusTeapot)
+		}
+		var body apiError
+		decode(t, w, &body)
+		if body.Message != message {
+			t.Errorf("message = %q, want %q", body.Message, message)
+		}
+	}
+}
+
+func TestCreateProductValidatesPrice(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		message string
+	}{
+		{`{"name":"Lamp","price":-5}`, "price must not be negative"},
+		{`{"name":"Lamp","price":"abc"}`, "Incorrect body"},
+		{`{"name":"Lamp"}`, "price is required"},
+	} {
+		store := newFakeStore()
+		w := serve(store, "POST", "/products", tc.body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", tc.body, w.Code)
+			continue
+		}
+		var body apiError
+		decode(t, w, &body)
+		if body.Message != tc.message {
+			t.Errorf("%s: message = %q, want %q", tc.body, body.Message, tc.message)
+		}
+		if len(store.products) != 0 {
+			t.Errorf("%s: product was stored", tc.body)
+		}
+	}
+}
+
+func TestUpdateProductValidatesPrice(t *testing.T) {
+	store := newFakeStore()
+	lamp := seed(store, "Lamp")[0]
+
+	for _, body := range []string{`{"name":"Lamp","price":-5}`, `{"name":"Lamp","price":"abc"}`} {
+		if w := serve(store, "PUT", "/products/"+lamp.ID.Hex(), body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, w.Code)
+		}
+	}
+	if store.products[lamp.ID].Price != lamp.Price {
+		t.Errorf("price changed to %v", store.products[lamp.ID].Price)
+	}
+}
+
+func TestUnencodableProductAnswers500(t *testing.T) {
+	// JSON has no NaN, so encoding this product fails
+	broken := Product{ID: bson.NewObjectId(), Name: "Broken", Price: math.NaN(), Views: 1}
+	store := newFakeStore(broken)
+
+	for _, url := range []string{"/products/" + broken.ID.Hex(), "/products?full=true", "/products/popular"} {
+		w := serve(store, "GET", url, "")
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: status = %d, want 500", url, w.Code)
+			continue
+		}
+		var body apiError
+		decode(t, w, &body)
+	}
+}
+
+func TestDuplicateNameConflicts(t *testing.T) {
+	store := newFakeStore()
+	products := seed(store, "Lamp", "Chair")
+
+	w := serve(store, "POST", "/products", `{"name":"Lamp","price":1}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("create: status = %d, want 409", w.Code)
+	}
+	var conflict struct {
+		ID bson.ObjectId `json:"id"`
+	}
+	decode(t, w, &conflict)
+	if conflict.ID != products[0].ID {
+		t.Errorf("create: conflicting id = %s, want the lamp %s", conflict.ID.Hex(), products[0].ID.Hex())
+	}
+
+	// Renaming the chair to the lamp's name conflicts too
+	w = serve(store, "PUT", "/products/"+products[1].ID.Hex(), `{"name":"Lamp","price":1}`)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("update: status = %d, want 409", w.Code)
+	}
+	decode(t, w, &conflict)
+	if conflict.ID != products[0].ID {
+		t.Errorf("update: conflicting id = %s, want the lamp", conflict.ID.Hex())
+	}
+}
+
+func TestNamelessProductsDontConflict(t *testing.T) {
+	store := newFakeStore()
+
+	for i := 0; i < 2; i++ {
+		if w := serve(store, "POST", "/products", `{"price":1}`); w.Code != http.StatusCreated {
+			t.Errorf("nameless create %d: status = %d, want 201", i, w.Code)
+		}
+	}
+}
+
+func TestUpdateRejectsStaleVersion(t *testing.T) {
+	store := newFakeStore()
+	lamp := seed(store, "Lamp")[0]
+	url := "/products/" + lamp.ID.Hex()
+
+	// Unversioned products are at version 0
+	w := serve(store, "PUT", url, `{"name":"Lamp","price":1,"version":0}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("current version: status = %d, want 204: %s", w.Code, w.Body)
+	}
+	if v := store.products[lamp.ID].Version; v != 1 {
+		t.Fatalf("version = %d after update, want 1", v)
+	}
+
+	// A client still holding version 0 is turned away
+	w = serve(store, "PUT", url, `{"name":"Lamp","price":2,"version":0}`)
+	if w.Code != http.StatusConflict {
+		t.Errorf("stale body version: status = %d, want 409", w.Code)
+	}
+
+	r := httptest.NewRequest("PUT", url, strings.NewReader(`{"name":"Lamp","price":2}`))
+	r.Header.Set("If-Match", `"0"`)
+	w = httptest.NewRecorder()
+	routes(store).ServeHTTP(w, r)
+	if w.Code != http.StatusConflict {
+		t.Errorf("stale If-Match: status = %d, want 409", w.Code)
+	}
+	if p := store.products[lamp.ID]; p.Price != 1 || p.Version != 1 {
+		t.Errorf("stale updates changed the product: %+v", p)
+	}
+
+	// Updates without a version apply to any
+	if w := serve(store, "PUT", url, `{"name":"Lamp","price":3}`); w.Code != http.StatusNoContent {
+		t.Errorf("unversioned update: status = %d, want 204", w.Code)
+	}
+}
+
+func TestDeleteProductsRequiresFilter(t *testing.T) {
+	store := newFakeStore()
+	seed(store, "Lamp", "Chair")
+
+	for _, url := range []string{"/products", "/products?dry_run=true", "/products?snapshot=new"} {
+		if w := serve(store, "DELETE", url, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", url, w.Code)
+		}
+	}
+	if len(store.products) != 2 {
+		t.Errorf("%d products left, want 2", len(store.products))
+	}
+}
+
+func TestDeleteProductsDryRunMatchesDelete(t *testing.T) {
+	// More lamps than one default page holds
+	names := []string{"Chair"}
+	for i := 0; i < DefaultLimit+5; i++ {
+		names = append(names, fmt.Sprintf("Lamp %d", i))
+	}
+	store := newFakeStore()
+	seed(store, names...)
+
+	w := serve(store, "DELETE", "/products?q=lamp&dry_run=true", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("dry run: status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var preview []Product
+	decode(t, w, &preview)
+	if len(store.products) != len(names) {
+		t.Fatalf("dry run deleted products")
+	}
+	if total := w.Header().Get("X-Total-Count"); total != strconv.Itoa(len(preview)) {
+		t.Errorf("X-Total-Count = %s but %d products listed", total, len(preview))
+	}
+
+	w = serve(store, "DELETE", "/products?q=lamp", "")
+	var result struct {
+		Deleted int `json:"deleted"`
+	}
+	decode(t, w, &result)
+	if result.Deleted != len(preview) || result.Deleted != len(names)-1 {
+		t.Errorf("deleted %d, dry run listed %d, want %d", result.Deleted, len(preview), len(names)-1)
+	}
+	for _, p := range preview {
+		if _, ok := store.products[p.ID]; ok {
+			t.Errorf("previewed %s was not deleted", p.Name)
+		}
+	}
+
+	for _, url := range []string{"/products?q=chair&limit=1", "/products?q=chair&offset=1&dry_run=true", "/products?q=chair&sort=name"} {
+		if w := serve(store, "DELETE", url, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", url, w.Code)
+		}
+	}
+}
+
+func TestCreateGuardRecordsOnlyStoredProducts(t *testing.T) {
+	defer func(window time.Duration) { config.CreateGuardWindow = window }(config.CreateGuardWindow)
+	config.CreateGuardWindow = time.Minute
+	store := newFakeStore()
+	seed(store, "Desk")
+
+	if w := serve(store, "POST", "/products", `{"name":"Desk","price":5}`); w.Code != http.StatusConflict {
+		t.Fatalf("duplicate: status = %d, want 409: %s", w.Code, w.Body)
+	}
+	if w := serve(store, "POST", "/products", `{"name":"Desk!","price":5}`); w.Code != http.StatusCreated {
+		t.Fatalf("retry after a conflict: status = %d, want 201: %s", w.Code, w.Body)
+	}
+	w := serve(store, "POST", "/products", `{"name":"desk","price":5}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("near-identical create: status = %d, Retry-After %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	w = serve(store, "POST", "/products/bulk", `[{"name":"Shelf","price":5},{"name":"shelf.","price":5}]`)
+	var result struct {
+		Items []struct {
+			Error string `json:"error"`
+		} `json:"items"`
+	}
+	decode(t, w, &result)
+	if len(result.Items) != 2 || result.Items[0].Error != "" || result.Items[1].Error == "" {
+		t.Errorf("bulk create of near-identical names: %s", w.Body)
+	}
+}
+
+// Returns the body size histogram as the admin listener serves it
+func bodySizeMetric(t *testing.T) (count, sum int64) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	getMetrics(w, httptest.NewRequest("GET", "/debug/vars", nil))
+
+	var metrics map[string]struct {
+		Count int64 `json:"count"`
+		Sum   int64 `json:"sum"`
+	}
+	decode(t, w, &metrics)
+	if _, ok := metrics["body_size_bytes"]; !ok || len(metrics) != 1 {
+		t.Fatalf("metrics = %s, want only body_size_bytes", w.Body)
+	}
+	return metrics["body_size_bytes"].Count, metrics["body_size_bytes"].Sum
+}
+
+func TestMetricsArentServedToClients(t *testing.T) {
+	if w := serve(newFakeStore(), "GET", "/debug/vars", ""); w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", w.Code)
+	}
+}
+
+func TestBodySizeMeasuredOnPost(t *testing.T) {
+	count, sum := bodySizeMetric(t)
+
+	body := `{"name":"Lamp","price":5}`
+	serve(newFakeStore(), "POST", "/products", body)
+	serve(newFakeStore(), "GET", "/products", "")
+
+	newCount, newSum := bodySizeMetric(t)
+	if newCount != count+1 || newSum != sum+int64(len(body)) {
+		t.Errorf("count %d -> %d, sum %d -> %d; want one more observation of %d bytes", count, newCount, sum, newSum, len(body))
+	}
+}
+
+// Serves a bulk create carrying an Idempotency-Key header
+func serveBulk(store ProductStore, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/products/bulk", strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	routes(store).ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotentBulkCreate(t *testing.T) {
+	store := newFakeStore()
+	body := `[{"name":"Lamp","price":5}]`
+
+	first := serveBulk(store, "k1", body)
+	retry := serveBulk(store, "k1", body)
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry = %d %s, want replay of %d %s", retry.Code, retry.Body, first.Code, first.Body)
+	}
+	if len(store.products) != 1 {
+		t.Errorf("%d products stored, want 1", len(store.products))
+	}
+
+	if w := serveBulk(store, "k1", `[{"name":"Desk","price":5}]`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reused key: status = %d, want 422", w.Code)
+	}
+}
+
+func TestIdempotencyKeyFreedOnFailure(t *testing.T) {
+	store := newFakeStore()
+	store.saveErr = fmt.Errorf("no primary")
+	serveBulk(store, "k1", `[{"name":"Lamp","price":5}]`)
+	if _, ok := store.keys["k1"]; ok {
+		t.Errorf("key still claimed after its response failed to save")
+	}
+
+	// Claimed by a request lost in a crash
+	store.keys["k2"] = &SavedResponse{Pending: true, Created: time.Now().Add(-2 * config.IdempotencyLease)}
+	if w := serveBulk(store, "k2", `[{"name":"Desk","price":5}]`); w.Code == http.StatusConflict {
+		t.Errorf("key still pending after its lease ran out")
+	}
+	store.keys["k3"] = &SavedResponse{Pending: true, Created: time.Now()}
+	if w := serveBulk(store, "k3", `[{"name":"Chair","price":5}]`); w.Code != http.StatusConflict {
+		t.Errorf("pending key: status = %d, want 409", w.Code)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	calls := 0
+	failing := func() error {
+		calls++
+		return fmt.Errorf("down")
+	}
+
+	if err := retry(backoff{Attempts: 3, Delay: time.Millisecond}, "test", failing); err == nil || calls != 3 {
+		t.Errorf("attempts: %d calls, err %v, want 3 calls and the error", calls, err)
+	}
+
+	calls = 0
+	start := time.Now()
+	if err := retry(backoff{Window: 50 * time.Millisecond, Delay: time.Millisecond, MaxDelay: 4 * time.Millisecond}, "test", failing); err == nil {
+		t.Errorf("window: err = nil, want the error")
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond || calls < 5 {
+		t.Errorf("window: %d calls over %s, want capped delays within the window", calls, elapsed)
+	}
+
+	calls = 0
+	if err := retry(backoff{Attempts: 3, Delay: time.Millisecond}, "test", func() error {
+		if calls++; calls < 2 {
+			return fmt.Errorf("down")
+		}
+		return nil
+	}); err != nil || calls != 2 {
+		t.Errorf("recovery: %d calls, err %v, want 2 calls and no error", calls, err)
+	}
+}
+
+func TestValidateBatchMatchesCreate(t *testing.T) {
+	defer func(escape bool, size int) { config.EscapeHTML, config.MaxDocumentSize = escape, size }(config.EscapeHTML, config.MaxDocumentSize)
+	config.EscapeHTML, config.MaxDocumentSize = true, 200
+
+	// The first fits as sent, but not once escaped
+	items := []string{
+		fmt.Sprintf(`{"name":"%s","price":5}`, strings.Repeat("<", 100)),
+		`{"name":"Lamp","price":5}`,
+	}
+
+	w := serve(newFakeStore(), "POST", "/products/validate-batch", "["+strings.Join(items, ",")+"]")
+	var result struct {
+		Items []struct {
+			Valid bool `json:"valid"`
+		} `json:"items"`
+	}
+	decode(t, w, &result)
+	if len(result.Items) != 2 {
+		t.Fatalf("validate-batch: %s", w.Body)
+	}
+
+	for i, body := range items {
+		w := serve(newFakeStore(), "POST", "/products", body)
+		if created := w.Code == http.StatusCreated; created != result.Items[i].Valid {
+			t.Errorf("item %d: validate-batch valid %t, create status %d", i, result.Items[i].Valid, w.Code)
+		}
+	}
+}
+
+func TestFinalPriceFollowsPriceDecimals(t *testing.T) {
+	defer func(decimals int) { config.PriceDecimals = decimals }(config.PriceDecimals)
+
+	for _, c := range []struct {
+		decimals        int
+		price, discount float64
+		want            float64
+	}{
+		{-1, 19.99, 15, 16.99},
+		{0, 10, 15, 9},
+		{3, 9.999, 10, 8.999},
+	} {
+		config.PriceDecimals = c.decimals
+		data, err := json.Marshal(Product{Price: c.price, Discount: c.discount})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got struct {
+			FinalPrice float64 `json:"final_price"`
+		}
+		json.Unmarshal(data, &got)
+		if got.FinalPrice != c.want {
+			t.Errorf("PRICE_DECIMALS %d: final price of %v less %v%% = %v, want %v", c.decimals, c.price, c.discount, got.FinalPrice, c.want)
+		}
+	}
+}
+
+func TestProductsTableEscapesNamesOnce(t *testing.T) {
+	defer func(escape bool) { config.EscapeHTML = escape }(config.EscapeHTML)
+
+	for _, escape := range []bool{false, true} {
+		config.EscapeHTML = escape
+		store := newFakeStore()
+		seed(store, "Tom & Jerry <b>")
+
+		w := serve(store, "GET", "/products.html", "")
+		if body := w.Body.String(); !strings.Contains(body, "<td>Tom &amp; Jerry &lt;b&gt;</td>") {
+			t.Errorf("ESCAPE_HTML %t: name not escaped exactly once in %s", escape, body)
+		}
+	}
+}
+
+func TestRetriedCreatePassesCreateGuard(t *testing.T) {
+	defer func(window time.Duration, retrySafe bool) {
+		config.CreateGuardWindow, config.RetrySafeCreate = window, retrySafe
+	}(config.CreateGuardWindow, config.RetrySafeCreate)
+	config.CreateGuardWindow, config.RetrySafeCreate = time.Minute, true
+	store := newFakeStore()
+
+	body := fmt.Sprintf(`{"id":"%s","name":"Stool","price":5}`, bson.NewObjectId().Hex())
+	if w := serve(store, "POST", "/products", body); w.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, want 201: %s", w.Code, w.Body)
+	}
+	if w := serve(store, "POST", "/products", body); w.Code != http.StatusOK {
+		t.Errorf("retry: status = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	other := fmt.Sprintf(`{"id":"%s","name":"stool","price":5}`, bson.NewObjectId().Hex())
+	if w := serve(store, "POST", "/products", other); w.Code != http.StatusTooManyRequests {
+		t.Errorf("near-identical create with a new id: status = %d, want 429", w.Code)
+	}
+}
+
+// Returns the comma separated hex ids of products at indexes of products
+func idList(products []Product, indexes ...int) string {
+	var hexes []string
+	for _, i := range indexes {
+		hexes = append(hexes, products[i].ID.Hex())
+	}
+	return strings.Join(hexes, ",")
+}
+
+func TestListByIdsIsUnpaged(t *testing.T) {
+	store := newFakeStore()
+	var names []string
+	for i := 0; i < DefaultLimit+10; i++ {
+		names = append(names, fmt.Sprintf("Lamp %d", i))
+	}
+	products := seed(store, names...)
+
+	// More ids than fit a default page still all come back
+	var all []int
+	for i := len(products) - 1; i >= 0; i-- {
+		all = append(all, i)
+	}
+	w := serve(store, "GET", "/products?ids="+idList(products, all...), "")
+	var listed []Product
+	decode(t, w, &listed)
+	if len(listed) != len(products) || listed[0].ID != products[len(products)-1].ID {
+		t.Errorf("listed %d of %d ids", len(listed), len(products))
+	}
+
+	for _, param := range []string{"limit=2", "offset=1", "sort=name", "order=newest"} {
+		w := serve(store, "GET", "/products?ids="+idList(products, 4, 3, 0)+"&"+param, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("ids with %s: status = %d, want 400", param, w.Code)
+		}
+	}
+}
+
+func TestListByIdsFollowsRequestedOrder(t *testing.T) {
+	store := newFakeStore()
+	products := seed(store, "P0", "P1", "P2", "P3", "P4")
+
+	w := serve(store, "GET", "/products?ids="+idList(products, 4, 3, 0), "")
+	var listed []Product
+	decode(t, w, &listed)
+	if len(listed) != 3 || idList(listed, 0, 1, 2) != idList(products, 4, 3, 0) {
+		t.Errorf("listed %s, want P4, P3, P0", w.Body)
+	}
+	if total := w.Header().Get("X-Total-Count"); total != "3" {
+		t.Errorf("X-Total-Count = %s, want 3", total)
+	}
+}
+
+func TestBatchSizeLimit(t *testing.T) {
+	defer func(size int) { config.MaxBatchSize = size }(config.MaxBatchSize)
+	config.MaxBatchSize = 2
+	item := `{"name":"Lamp","price":5}`
+
+	for _, url := range []string{"/products/bulk", "/products/validate-batch"} {
+		// What follows the item over the limit is never read
+		w := serve(newFakeStore(), "POST", url, "["+item+","+item+","+item+",not json")
+		var body map[string]string
+		decode(t, w, &body)
+		if w.Code != http.StatusBadRequest || !strings.Contains(body["message"], "limit of 2 items") {
+			t.Errorf("%s over the limit: %d %s, want 400 naming the limit", url, w.Code, w.Body)
+		}
+
+		if w := serve(newFakeStore(), "POST", url, "["+item+","+item+"]"); w.Code != http.StatusOK && w.Code != http.StatusCreated {
+			t.Errorf("%s at the limit: status = %d: %s", url, w.Code, w.Body)
+		}
+	}
+}
+
+func TestBatchBytesLimit(t *testing.T) {
+	defer func(size int) { config.MaxBatchBytes = size }(config.MaxBatchBytes)
+	config.MaxBatchBytes = 100
+	items := strings.TrimSuffix(strings.Repeat(`{"name":"Lamp","price":5},`, 5), ",")
+
+	for _, url := range []string{"/products/bulk", "/products/validate-batch"} {
+		w := serve(newFakeStore(), "POST", url, "["+items+"]")
+		if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "limit of 100 bytes") {
+			t.Errorf("%s: %d %s, want 413 naming the limit", url, w.Code, w.Body)
+		}
+	}
+	if w := serveBulk(newFakeStore(), "k1", "["+items+"]"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("bulk with an Idempotency-Key: status = %d, want 413", w.Code)
+	}
+}
+
+func TestIndexHintApplied(t *testing.T) {
+	defer func(hints []IndexHint) { config.IndexHints = hints }(config.IndexHints)
+	config.IndexHints = []IndexHint{{Field: "keywords", Index: "keywords"}}
+
+	for url, want := range map[string]string{
+		"/products?q=lamp&explain=true":    "keywords",
+		"/products?name=lamp&explain=true": "",
+	} {
+		var explained listQuery
+		decode(t, serve(newFakeStore(), "GET", url, ""), &explained)
+		if explained.Hint != want {
+			t.Errorf("%s: hint %q, want %q", url, explained.Hint, want)
+		}
+	}
+}
+
+func TestHintableIndexes(t *testing.T) {
+	indexes := []storedIndex{
+		{Key: bson.D{{Name: "_id", Value: 1}}},
+		{Key: bson.D{{Name: "keywords", Value: 1.0}}},
+		{Key: bson.D{{Name: "views", Value: int64(-1)}}},
+		{Key: bson.D{{Name: "name", Value: 1}}, Partial: bson.M{"name": bson.M{"$gt": ""}}},
+		{Key: bson.D{{Name: "number", Value: 1}}, Sparse: true},
+	}
+
+	for index, ok := range map[string]bool{
+		"keywords": true, "-views": true, "_id": true,
+		"views": false, "-keywords": false, "name": false, "number": false, "price": false,
+	} {
+		err := hintableIndexes([]IndexHint{{Field: "f", Index: index}}, indexes)
+		if (err == nil) != ok {
+			t.Errorf("hint %s: err = %v, want hintable %t", index, err, ok)
+		}
+	}
+}
+
+func TestKeywordsComeFromAllNames(t *testing.T) {
+	p := Product{Name: "Desk Lamp", Names: map[string]string{"de": "Schreibtisch-Lampe", "fr": "Lampe de bureau"}}
+	got := map[string]bool{}
+	for _, term := range keywords(&p) {
+		if got[term] {
+			t.Errorf("keyword %q repeated", term)
+		}
+		got[term] = true
+	}
+	for _, want := range []string{"desk", "lamp", "schreibtisch", "lampe", "bureau"} {
+		if !got[want] {
+			t.Errorf("keywords %v lack %q", keywords(&p), want)
+		}
+	}
+
+	store := newFakeStore()
+	serve(store, "POST", "/products", `{"name":"Desk Lamp","price":5,"names":{"fr":"Lampe de bureau"}}`)
+	var listed []Product
+	decode(t, serve(store, "GET", "/products?q=bureau", ""), &listed)
+	if len(listed) != 1 {
+		t.Errorf("?q= on a localized name listed %d products, want 1", len(listed))
+	}
+}
+
+func TestSnapshotLeavesOutNewerProducts(t *testing.T) {
+	var old []Product
+	for i := 0; i < 3; i++ {
+		old = append(old, Product{ID: bson.NewObjectIdWithTime(time.Now().Add(time.Duration(i-10) * time.Minute)), Name: fmt.Sprintf("Old %d", i), Price: 5})
+	}
+	store := newFakeStore(old...)
+
+	w := serve(store, "GET", "/products?snapshot=new&limit=2", "")
+	token := w.Header().Get("X-Snapshot-Token")
+	if token == "" {
+		t.Fatalf("no X-Snapshot-Token: %s", w.Body)
+	}
+
+	// Even within the second the token was taken in, these are newer
+	seed(store, "New 0", "New 1")
+
+	w = serve(store, "GET", "/products?limit=2&offset=2&snapshot="+token, "")
+	var page []Product
+	decode(t, w, &page)
+	if len(page) != 1 || page[0].ID != old[2].ID {
+		t.Errorf("second page %s, want only %s", w.Body, old[2].Name)
+	}
+	if total := w.Header().Get("X-Total-Count"); total != "3" {
+		t.Errorf("X-Total-Count = %s, want the 3 products in the snapshot", total)
+	}
+
+	decode(t, serve(store, "GET", "/products?limit=10", ""), &page)
+	if len(page) != 5 {
+		t.Errorf("without the snapshot %d products listed, want 5", len(page))
+	}
+}
+
+func TestConcurrentCreatesGetDistinctNumbers(t *testing.T) {
+	store := newFakeStore()
+	mux := routes(store)
+
+	const creates = 20
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("POST", "/products", strings.NewReader(fmt.Sprintf(`{"name":"Lamp %d","price":5}`, i))))
+			if w.Code != http.StatusCreated {
+				t.Errorf("create %d: status = %d", i, w.Code)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[int]bool{}
+	for _, p := range store.products {
+		if seen[p.Number] || p.Number < 1 || p.Number > creates {
+			t.Errorf("number %d repeated or out of 1..%d", p.Number, creates)
+		}
+		seen[p.Number] = true
+	}
+}
+
+func TestNumberBlock(t *testing.T) {
+	products := make([]Product, 3)
+	numberBlock(products, 12)
+	for i, want := range []int{10, 11, 12} {
+		if products[i].Number != want {
+			t.Errorf("product %d numbered %d, want %d", i, products[i].Number, want)
+		}
+	}
+
+	store := newFakeStore()
+	seed(store, "Desk")
+	w := serve(store, "POST", "/products/bulk", `[{"name":"Lamp","price":5},{"name":"Desk","price":5},{"name":"Chair","price":5}]`)
+	var result struct {
+		Items []struct {
+			ID bson.ObjectId `json:"id"`
+		} `json:"items"`
+	}
+	decode(t, w, &result)
+	if len(result.Items) != 3 || store.products[result.Items[0].ID].Number != 2 || store.products[result.Items[2].ID].Number != 4 {
+		t.Errorf("bulk create after product 1 numbered its products %v, want 2 and 4 around the duplicate", store.products)
+	}
+}
+
+func TestRetrySafeCreateStoresOnce(t *testing.T) {
+	defer func(retrySafe bool) { config.RetrySafeCreate = retrySafe }(config.RetrySafeCreate)
+	config.RetrySafeCreate = true
+	store := newFakeStore()
+	id := bson.NewObjectId().Hex()
+
+	first := serve(store, "POST", "/products", `{"id":"`+id+`","name":"Lamp","price":5}`)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, want 201: %s", first.Code, first.Body)
+	}
+	retry := serve(store, "POST", "/products", `{"id":"`+id+`","name":"Lamp","price":7}`)
+	if retry.Code != http.StatusOK {
+		t.Fatalf("retry: status = %d, want 200: %s", retry.Code, retry.Body)
+	}
+
+	var stored Product
+	decode(t, retry, &stored)
+	if stored.ID.Hex() != id || stored.Price != 5 || stored.Number != 1 {
+		t.Errorf("retry answered %+v, want the product stored first", stored)
+	}
+	if len(store.products) != 1 || store.number != 1 {
+		t.Errorf("%d products and %d numbers taken, want 1 of each", len(store.products), store.number)
+	}
+	if retry.Header().Get("Location") != "/products/"+id {
+		t.Errorf("Location = %q", retry.Header().Get("Location"))
+	}
+}
+
+func TestRoundTo(t *testing.T) {
+	for _, c := range []struct {
+		price    float64
+		decimals int
+		want     float64
+	}{
+		{19.995, 2, 20},
+		{1.005, 2, 1.01},
+		{2.675, 2, 2.68},
+		{0.125, 2, 0.13},
+		{-0.125, 2, -0.13},
+		{12.5, 0, 13},
+		{1234.5678, 3, 1234.568},
+		{1e300, 2, 1e300},
+	} {
+		if got := roundTo(c.price, c.decimals); got != c.want {
+			t.Errorf("roundTo(%v, %d) = %v, want %v", c.price, c.decimals, got, c.want)
+		}
+	}
+}
+
+func TestStoredPricesRounded(t *testing.T) {
+	defer func(decimals int, reject bool) {
+		config.PriceDecimals, config.RejectUnroundedPrices = decimals, reject
+	}(config.PriceDecimals, config.RejectUnroundedPrices)
+
+	for _, c := range []struct {
+		decimals int
+		reject   bool
+		price    string
+		status   int
+		stored   float64
+	}{
+		{2, false, "19.995", http.StatusCreated, 20},
+		{2, false, "19.99", http.StatusCreated, 19.99},
+		{-1, false, "19.995", http.StatusCreated, 19.995},
+		{2, true, "19.995", http.StatusBadRequest, 0},
+		{2, true, "19.99", http.StatusCreated, 19.99},
+	} {
+		config.PriceDecimals, config.RejectUnroundedPrices = c.decimals, c.reject
+		store := newFakeStore()
+
+		w := serve(store, "POST", "/products", `{"name":"Lamp","price":`+c.price+`}`)
+		if w.Code != c.status {
+			t.Errorf("price %s at %d decimals, reject %t: status = %d, want %d", c.price, c.decimals, c.reject, w.Code, c.status)
+			continue
+		}
+		for _, p := range store.products {
+			if p.Price != c.stored {
+				t.Errorf("price %s at %d decimals: stored %v, want %v", c.price, c.decimals, p.Price, c.stored)
+			}
+		}
+	}
+}
+
+func TestDatabaseErrorDetail(t *testing.T) {
+	defer func(production bool) { config.Production = production }(config.Production)
+	store := newFakeStore()
+	store.err = fmt.Errorf(`no reachable servers at mongodb://admin:hunter2@db:27017: E11000 dup key { name: "Lamp" }` + "\nstack")
+
+	for _, c := range []struct {
+		production bool
+		want       string
+	}{
+		{true, "Database error"},
+		{false, "Database error: no reachable servers at mongodb://***@db:27017: E11000 dup key"},
+	} {
+		config.Production = c.production
+		var body map[string]string
+		decode(t, serve(store, "GET", "/products", ""), &body)
+		if body["message"] != c.want {
+			t.Errorf("production %t: message %q, want %q", c.production, body["message"], c.want)
+		}
+	}
+
+	if msg := sanitizeError(fmt.Errorf("%s", strings.Repeat("x", 300))); len(msg) != 200 {
+		t.Errorf("sanitized message of %d bytes, want it cut to 200", len(msg))
+	}
+}
+
+func TestLongQueryStringRejected(t *testing.T) {
+	defer func(length int) { config.MaxQueryLength = length }(config.MaxQueryLength)
+	config.MaxQueryLength = 20
+
+	if w := serve(newFakeStore(), "GET", "/products?name="+strings.Repeat("a", 20), ""); w.Code != http.StatusRequestURITooLong {
+		t.Errorf("status = %d, want 414", w.Code)
+	}
+	if w := serve(newFakeStore(), "GET", "/products?name=lamp", ""); w.Code != http.StatusOK {
+		t.Errorf("short query: status = %d, want 200", w.Code)
+	}
+}
+
+func TestOversizedProductsRejected(t *testing.T) {
+	defer func(size int) { config.MaxDocumentSize = size }(config.MaxDocumentSize)
+	config.MaxDocumentSize = 200
+	store := newFakeStore()
+	products := seed(store, "Lamp")
+	big := fmt.Sprintf(`{"name":"%s","price":5}`, strings.Repeat("x", 200))
+
+	if w := serve(store, "POST", "/products", big); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("create: status = %d, want 413", w.Code)
+	}
+	if w := serve(store, "PUT", "/products/"+products[0].ID.Hex(), big); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("update: status = %d, want 413", w.Code)
+	}
+	if len(store.products) != 1 || store.products[products[0].ID].Name != "Lamp" {
+		t.Errorf("oversized products were written")
+	}
+}
+
+func TestIdempotentDelete(t *testing.T) {
+	defer func(idempotent bool) { config.IdempotentDelete = idempotent }(config.IdempotentDelete)
+	config.IdempotentDelete = true
+	store := newFakeStore()
+	products := seed(store, "Lamp")
+	url := "/products/" + products[0].ID.Hex()
+
+	for i := 0; i < 2; i++ {
+		if w := serve(store, "DELETE", url, ""); w.Code != http.StatusNoContent {
+			t.Errorf("delete %d: status = %d, want 204", i+1, w.Code)
+		}
+	}
+	if len(store.products) != 0 {
+		t.Errorf("product not deleted")
+	}
+}
+
+func TestListOrder(t *testing.T) {
+	store := newFakeStore()
+	products := seed(store, "First", "Second", "Third")
+
+	for order, want := range map[string][]int{"newest": {2, 1, 0}, "oldest": {0, 1, 2}} {
+		var listed []Product
+		decode(t, serve(store, "GET", "/products?order="+order, ""), &listed)
+		if len(listed) != 3 || idList(listed, 0, 1, 2) != idList(products, want...) {
+			t.Errorf("order=%s listed %v", order, listed)
+		}
+	}
+
+	if w := serve(store, "GET", "/products?order=random", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid order: status = %d, want 400", w.Code)
+	}
+}
+
+func TestIncompleteProducts(t *testing.T) {
+	defer func(fields []string) { config.RequiredFields = fields }(config.RequiredFields)
+	config.RequiredFields = []string{"name", "location"}
+	here := &GeoPoint{Type: "Point", Coordinates: []float64{13.4, 52.5}}
+	store := newFakeStore()
+	for _, p := range []Product{
+		{Name: "Complete", Price: 5, Location: here},
+		{Name: "", Price: 5, Location: here},
+		{Name: "Nowhere", Price: 5},
+	} {
+		p := p
+		store.Insert(&p)
+	}
+
+	var listed []Product
+	decode(t, serve(store, "GET", "/products/incomplete", ""), &listed)
+	if len(listed) != 2 || listed[0].Name != "" || listed[1].Name != "Nowhere" {
+		t.Errorf("incomplete products %+v, want the nameless and the located-nowhere ones", listed)
+	}
+
+	decode(t, serve(store, "GET", "/products/incomplete?limit=1&offset=1", ""), &listed)
+	if len(listed) != 1 || listed[0].Name != "Nowhere" {
+		t.Errorf("second page %+v, want the located-nowhere product", listed)
+	}
+}
+
+func TestExplainReportsQuery(t *testing.T) {
+	w := serve(newFakeStore(), "GET", "/products?q=Desk+lamp&minPrice=2&sort=-price&order=newest&limit=5&offset=10&fields=name,price&explain=true", "")
+	var explained struct {
+		Filter struct {
+			Keywords struct {
+				In []string `json:"$in"`
+			} `json:"keywords"`
+			Price map[string]float64 `json:"price"`
+		} `json:"filter"`
+		Sort       []string       `json:"sort"`
+		Projection map[string]int `json:"projection"`
+		Limit      int            `json:"limit"`
+		Skip       int            `json:"skip"`
+	}
+	decode(t, w, &explained)
+
+	if strings.Join(explained.Filter.Keywords.In, " ") != "desk lamp" || explained.Filter.Price["$gte"] != 2 || len(explained.Filter.Price) != 1 {
+		t.Errorf("filter not explained: %s", w.Body)
+	}
+	if strings.Join(explained.Sort, ",") != "-price,-_id" {
+		t.Errorf("sort %v, want -price,-_id", explained.Sort)
+	}
+	if explained.Projection["name"] != 1 || explained.Projection["price"] != 1 || explained.Projection["discount"] != 0 {
+		t.Errorf("projection %v, want name and price", explained.Projection)
+	}
+	if explained.Limit != 5 || explained.Skip != 10 {
+		t.Errorf("limit %d and skip %d, want 5 and 10", explained.Limit, explained.Skip)
+	}
+}
+
+func TestPopularProductsByViews(t *testing.T) {
+	store := newFakeStore()
+	products := seed(store, "Lamp", "Desk", "Chair")
+	for _, i := range []int{1, 2, 1, 1} {
+		serve(store, "GET", "/products/"+products[i].ID.Hex(), "")
+	}
+
+	var popular []Product
+	decode(t, serve(store, "GET", "/products/popular", ""), &popular)
+	if len(popular) != 2 || popular[0].Name != "Desk" || popular[1].Name != "Chair" {
+		t.Errorf("popular %+v, want Desk then Chair, and no unviewed Lamp", popular)
+	}
+
+	decode(t, serve(store, "GET", "/products/popular?n=1", ""), &popular)
+	if len(popular) != 1 || popular[0].Name != "Desk" {
+		t.Errorf("n=1 listed %+v, want Desk", popular)
+	}
+	if w := serve(store, "GET", "/products/popular?n=0", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("n=0: status = %d, want 400", w.Code)
+	}
+}
+
+func TestPriceBuckets(t *testing.T) {
+	store := newFakeStore()
+	seed(store, "A", "B", "C", "D", "E", "F")
+
+	var buckets []PriceBucket
+	decode(t, serve(store, "GET", "/products/price-buckets?size=2&minPrice=20", ""), &buckets)
+	if len(buckets) != 2 || buckets[0] != (PriceBucket{Min: 20, Max: 50, Count: 3}) || buckets[1] != (PriceBucket{Min: 50, Max: 60, Count: 2}) {
+		t.Errorf("buckets %+v, want the 5 prices from 20 split in 2", buckets)
+	}
+
+	serve(store, "GET", "/products/price-buckets", "")
+	if store.bucketsAsked != 10 {
+		t.Errorf("default size asked for %d buckets, want 10", store.bucketsAsked)
+	}
+	serve(store, "GET", fmt.Sprintf("/products/price-buckets?size=%d", MaxBuckets+1), "")
+	if store.bucketsAsked != MaxBuckets {
+		t.Errorf("size over the cap asked for %d buckets, want %d", store.bucketsAsked, MaxBuckets)
+	}
+
+	for _, size := range []string{"0", "-1", "many"} {
+		if w := serve(store, "GET", "/products/price-buckets?size="+size, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("size=%s: status = %d, want 400", size, w.Code)
+		}
+	}
+	if w := serve(store, "GET", "/products/price-buckets?minPrice=cheap", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("bad filter: status = %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Rejects write requests without config.APIKey, given as an X-API-Key
+// header or an Authorization: Bearer header. Reads stay public. Without a
+// configured key every request is let through.
+func requireAPIKey(h http.Handler) http.Handler {
+	if config.APIKey == "" {
+		log.Println("API_KEY is not set, write requests are not authenticated")
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(config.APIKey)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			ErrorWithJSON(w, "Invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
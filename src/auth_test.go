@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Serves a request with the given headers through the API's routes
+func serveWithHeaders(store ProductStore, method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	routes(store).ServeHTTP(w, r)
+	return w
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	defer func(key string) { config.APIKey = key }(config.APIKey)
+	config.APIKey = "secret"
+	body := `{"name":"Lamp","price":5}`
+
+	for _, c := range []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"missing key", nil, http.StatusUnauthorized},
+		{"wrong key", map[string]string{"X-API-Key": "guess"}, http.StatusUnauthorized},
+		{"wrong bearer", map[string]string{"Authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"key without Bearer", map[string]string{"Authorization": "Basic secret"}, http.StatusUnauthorized},
+		{"X-API-Key", map[string]string{"X-API-Key": "secret"}, http.StatusCreated},
+		{"bearer", map[string]string{"Authorization": "Bearer secret"}, http.StatusCreated},
+	} {
+		w := serveWithHeaders(newFakeStore(), "POST", "/products", body, c.headers)
+		if w.Code != c.want {
+			t.Errorf("%s: status = %d, want %d", c.name, w.Code, c.want)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s: 401 without WWW-Authenticate: Bearer", c.name)
+		}
+	}
+
+	for _, url := range []string{"/products", "/health"} {
+		if w := serve(newFakeStore(), "GET", url, ""); w.Code != http.StatusOK {
+			t.Errorf("GET %s without a key: status = %d, want 200", url, w.Code)
+		}
+	}
+}
+
+func TestUnsetAPIKeyAllowsWrites(t *testing.T) {
+	defer func(key string) { config.APIKey = key }(config.APIKey)
+	config.APIKey = ""
+
+	if w := serve(newFakeStore(), "POST", "/products", `{"name":"Lamp","price":5}`); w.Code != http.StatusCreated {
+		t.Errorf("status = %d, want 201", w.Code)
+	}
+}
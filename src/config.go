@@ -0,0 +1,245 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings read from the environment on startup
+type Config struct {
+	// Mongo connection string, MONGO_URI
+	MongoURI string
+	// Database holding the products, MONGO_DB
+	Database string
+	// Collection holding the products, MONGO_COLLECTION
+	Collection string
+	// Address the HTTP server listens on, LISTEN_ADDR
+	ListenAddr string
+	// Address the admin server serving metrics listens on, ADMIN_ADDR.
+	// "off" turns it off.
+	AdminAddr string
+
+	// Opt-in HTML escaping of string fields on write, for deployments that
+	// render product data in web pages. Off by default to avoid
+	// double-escaping for API-only consumers.
+	EscapeHTML bool
+	// Longest raw query string accepted before answering 414
+	MaxQueryLength int
+	// Largest BSON encoded product accepted on write, well under Mongo's
+	// 16MB cap
+	MaxDocumentSize int
+	// Fields a product must have to be considered complete
+	RequiredFields []string
+	// How many times index creation is attempted on startup before giving up
+	IndexAttempts int
+	// Responses only carry database error details outside production
+	Production bool
+	// Answer 204 when deleting a product that is already gone, so clients
+	// can safely retry deletes
+	IdempotentDelete bool
+	// Most items accepted in one request by the batch endpoints
+	MaxBatchSize int
+	// Largest body in bytes accepted by the batch endpoints
+	MaxBatchBytes int
+	// Let clients supply the id of created products and make create an
+	// upsert on it, so a retried create doesn't duplicate the product
+	RetrySafeCreate bool
+	// Locale whose name is used when none of the requested locales is
+	// available
+	DefaultLocale string
+	// JSON fields returned by ?view=mobile
+	MobileFields []string
+	// Fields returned by the product list unless more are asked for
+	SummaryFields []string
+	// How many products the Atom feed lists
+	FeedSize int
+	// Author the Atom feed names, as its entries name none
+	FeedAuthor string
+	// How product views are counted: every, sampled or buffered
+	ViewCounting string
+	// One in how many views is counted when sampling
+	ViewSampleRate int
+	// How often buffered view counts are written to Mongo
+	ViewFlushInterval time.Duration
+	// How soon after a create another product with a near-identical name
+	// is refused, or 0 to allow it
+	CreateGuardWindow time.Duration
+	// Decimal places prices are kept to, or -1 to keep them as sent
+	PriceDecimals int
+	// Whether prices with more decimal places are rejected instead of
+	// rounded
+	RejectUnroundedPrices bool
+	// How long responses are kept for replay by idempotency key
+	IdempotencyTTL time.Duration
+	// How long a request may hold an idempotency key before retries may
+	// take it over, so keys of requests lost in a crash free up
+	IdempotencyLease time.Duration
+	// How long one attempt to connect to Mongo may take
+	DialTimeout time.Duration
+	// How long to keep retrying to connect to Mongo on startup
+	DialWindow time.Duration
+	// Whether reads failing on the primary are retried on a secondary
+	SecondaryFallback bool
+	// Endpoints where identical concurrent requests share one response
+	DedupeEndpoints []string
+	// Indexes the product list is told to use, by filter field
+	IndexHints []IndexHint
+	// API versions clients may declare, oldest first
+	APIVersions []string
+	// Key write requests must present, or empty to allow anonymous writes
+	APIKey string
+	// How long in-flight requests get to finish on shutdown
+	ShutdownTimeout time.Duration
+}
+
+// Forces the product list onto the index with the given key whenever it
+// filters on Field
+type IndexHint struct {
+	Field string
+	Index string
+}
+
+// Active configuration, loaded from the environment on startup
+var config = loadConfig()
+
+// Reads the configuration from the environment, using defaults for unset
+// variables
+func loadConfig() Config {
+	cfg := Config{
+		MongoURI:   envString("MONGO_URI", "localhost"),
+		Database:   envString("MONGO_DB", "store"),
+		Collection: envString("MONGO_COLLECTION", "products"),
+		ListenAddr: envString("LISTEN_ADDR", "localhost:8080"),
+		AdminAddr:  envString("ADMIN_ADDR", "localhost:8081"),
+
+		EscapeHTML:       envBool("ESCAPE_HTML"),
+		MaxQueryLength:   envInt("MAX_QUERY_LENGTH", 2048),
+		MaxDocumentSize:  envInt("MAX_DOCUMENT_SIZE", 1<<20),
+		RequiredFields:   envList("REQUIRED_FIELDS", "name,price"),
+		IndexAttempts:    envInt("INDEX_ATTEMPTS", 5),
+		Production:       envString("APP_ENV", "production") == "production",
+		IdempotentDelete: envBool("IDEMPOTENT_DELETE"),
+		MaxBatchSize:     envInt("MAX_BATCH_SIZE", 1000),
+		MaxBatchBytes:    envInt("MAX_BATCH_BYTES", 16<<20),
+		RetrySafeCreate:  envBool("RETRY_SAFE_CREATE"),
+		DefaultLocale:    envString("DEFAULT_LOCALE", "en"),
+		MobileFields:     envList("MOBILE_FIELDS", "id,name,price"),
+		SummaryFields:    envList("SUMMARY_FIELDS", "id,name,price"),
+		FeedSize:         envInt("FEED_SIZE", 20),
+		FeedAuthor:       envString("FEED_AUTHOR", "Products"),
+
+		ViewCounting:      envString("VIEW_COUNTING", CountEvery),
+		ViewSampleRate:    envInt("VIEW_SAMPLE_RATE", 10),
+		ViewFlushInterval: envDuration("VIEW_FLUSH_INTERVAL", 10*time.Second),
+
+		CreateGuardWindow:     envDuration("CREATE_GUARD_WINDOW", 0),
+		PriceDecimals:         envInt("PRICE_DECIMALS", -1),
+		RejectUnroundedPrices: envBool("REJECT_UNROUNDED_PRICES"),
+
+		IdempotencyTTL:    envDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+		IdempotencyLease:  envDuration("IDEMPOTENCY_LEASE", time.Minute),
+		DialTimeout:       envDuration("MONGO_DIAL_TIMEOUT", 5*time.Second),
+		DialWindow:        envDuration("MONGO_DIAL_WINDOW", 30*time.Second),
+		SecondaryFallback: envBool("SECONDARY_FALLBACK"),
+		DedupeEndpoints:   envList("DEDUPE_ENDPOINTS", ""),
+		IndexHints:        envIndexHints("INDEX_HINTS"),
+		APIVersions:       envList("API_VERSIONS", "1"),
+		APIKey:            envString("API_KEY", ""),
+		ShutdownTimeout:   envDuration("SHUTDOWN_TIMEOUT", 10*time.Second),
+	}
+
+	switch cfg.ViewCounting {
+	case CountEvery, CountSampled, CountBuffered:
+	default:
+		log.Fatalf("Invalid VIEW_COUNTING: %q", cfg.ViewCounting)
+	}
+	if len(cfg.APIVersions) == 0 {
+		log.Fatal("API_VERSIONS must list at least one version")
+	}
+	if cfg.ViewSampleRate < 1 || cfg.ViewFlushInterval <= 0 {
+		log.Fatal("VIEW_SAMPLE_RATE and VIEW_FLUSH_INTERVAL must be positive")
+	}
+	if err := checkFields(cfg.MobileFields); err != nil {
+		log.Fatal("Invalid MOBILE_FIELDS: ", err)
+	}
+	if err := checkFields(cfg.SummaryFields); err != nil {
+		log.Fatal("Invalid SUMMARY_FIELDS: ", err)
+	}
+
+	return cfg
+}
+
+// Reads an integer from the environment, falling back to def when unset
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	failOnError(err, "Invalid "+name)
+	return n
+}
+
+// Reads a duration such as 10s from the environment, falling back to def
+// when unset
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	failOnError(err, "Invalid "+name)
+	return d
+}
+
+// Reads a boolean from the environment, false when unset
+func envBool(name string) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	failOnError(err, "Invalid "+name)
+	return b
+}
+
+// Reads a string from the environment, falling back to def when unset
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// Reads a comma separated list from the environment, falling back to def
+// when unset
+func envList(name, def string) []string {
+	v := os.Getenv(name)
+	if v == "" {
+		v = def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Reads a comma separated list of field=index hints, e.g.
+// name=name,keywords=keywords
+func envIndexHints(name string) []IndexHint {
+	var hints []IndexHint
+	for _, item := range envList(name, "") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Fatalf("Invalid %s: %q is not field=index", name, item)
+		}
+		hints = append(hints, IndexHint{Field: parts[0], Index: parts[1]})
+	}
+	return hints
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+)
+
+// A response recorded to be replayed to several clients
+type recordedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recordedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *recordedResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *recordedResponse) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
+
+// An in-flight request that identical requests wait on
+type flight struct {
+	done     chan struct{}
+	response *recordedResponse
+}
+
+// Identical in-flight requests, by key
+var flights = struct {
+	sync.Mutex
+	m map[string]*flight
+}{m: map[string]*flight{}}
+
+// Makes identical requests to the named endpoint that arrive while one is
+// in flight wait for it and share its response, so they cost one database
+// computation. Only endpoints listed in config.DedupeEndpoints are wrapped.
+func dedupe(name string, h func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	enabled := false
+	for _, endpoint := range config.DedupeEndpoints {
+		enabled = enabled || endpoint == name
+	}
+	if !enabled {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Responses vary with the negotiated type and language
+		key := r.URL.RequestURI() + "\x00" + r.Header.Get("Accept") + "\x00" + r.Header.Get("Accept-Language")
+
+		flights.Lock()
+		f, waiting := flights.m[key]
+		if !waiting {
+			f = &flight{done: make(chan struct{}), response: &recordedResponse{header: http.Header{}}}
+			flights.m[key] = f
+		}
+		flights.Unlock()
+
+		if waiting {
+			<-f.done
+		} else {
+			lead(key, f, h, r)
+		}
+
+		for name, values := range f.response.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(f.response.status)
+		w.Write(f.response.body.Bytes())
+	}
+}
+
+// Records the response of h to r for the flight, then releases the
+// requests waiting on it, even if h panics
+func lead(key string, f *flight, h func(w http.ResponseWriter, r *http.Request), r *http.Request) {
+	defer func() {
+		flights.Lock()
+		delete(flights.m, key)
+		flights.Unlock()
+
+		if f.response.status == 0 {
+			f.response.status = http.StatusInternalServerError
+		}
+		close(f.done)
+	}()
+
+	h(f.response, r)
+	if f.response.status == 0 {
+		f.response.status = http.StatusOK
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Store whose lists block until released, counting them
+type blockingStore struct {
+	*fakeStore
+	lists   int32
+	release chan struct{}
+}
+
+func (s *blockingStore) All(q *listQuery) ([]Product, int, error) {
+	atomic.AddInt32(&s.lists, 1)
+	<-s.release
+	return s.fakeStore.All(q)
+}
+
+func TestDedupeSharesOneDatabaseCall(t *testing.T) {
+	defer func(endpoints []string) { config.DedupeEndpoints = endpoints }(config.DedupeEndpoints)
+	config.DedupeEndpoints = []string{"list"}
+	store := &blockingStore{fakeStore: newFakeStore(), release: make(chan struct{})}
+	seed(store.fakeStore, "Lamp")
+	mux := routes(store)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", "/products", nil))
+			codes[i] = w.Code
+		}(i)
+	}
+
+	// Let the identical requests arrive while the first is in flight
+	for atomic.LoadInt32(&store.lists) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+
+	if lists := atomic.LoadInt32(&store.lists); lists != 1 {
+		t.Errorf("%d database calls, want 1", lists)
+	}
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %d: status = %d, want 200", i, code)
+		}
+	}
+}
+
+func TestDedupeReleasesWaitersWhenLeaderPanics(t *testing.T) {
+	defer func(endpoints []string) { config.DedupeEndpoints = endpoints }(config.DedupeEndpoints)
+	config.DedupeEndpoints = []string{"list"}
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	calls := int32(0)
+	h := dedupe("list", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(entered)
+			<-release
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	go func() {
+		defer func() { recover() }()
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", "/products", nil))
+	}()
+	<-entered
+
+	waiter := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/products", nil))
+		waiter <- w.Code
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case code := <-waiter:
+		if code != http.StatusInternalServerError {
+			t.Errorf("waiter status = %d, want 500", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter still blocked after the leader panicked")
+	}
+
+	// The flight is gone, so the next request runs the handler
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/products", nil))
+	if w.Code != http.StatusOK || atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("after the panic: status %d after %d calls, want 200 from a new call", w.Code, calls)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// Returns the scheme and host the request was made to
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// Returns an Atom feed of the most recently added products, newest first.
+// Products have no modification time, so entries are dated by creation,
+// which their ObjectId records.
+func getProductsFeed(store ProductStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		products, err := store.Newest(config.FeedSize)
+		if err != nil {
+			DatabaseErrorWithJSON(w, err)
+			log.Println("Failed get products feed: ", err)
+			return
+		}
+		localize(r, products)
+
+		base := baseURL(r)
+		feed := atomFeed{
+			Title:   "Products",
+			ID:      base + "/products",
+			Updated: time.Now().UTC().Format(time.RFC3339),
+			// Entries name no author, so Atom requires the feed to
+			Author: atomPerson{Name: config.FeedAuthor},
+			Links: []atomLink{
+				{Href: base + r.URL.Path, Rel: "self"},
+				{Href: base + "/products"},
+			},
+		}
+		if len(products) > 0 {
+			feed.Updated = products[0].ID.Time().UTC().Format(time.RFC3339)
+		}
+
+		for _, p := range products {
+			url := base + "/products/" + p.ID.Hex()
+			feed.Entries = append(feed.Entries, atomEntry{
+				Title:   p.Name,
+				ID:      url,
+				Updated: p.ID.Time().UTC().Format(time.RFC3339),
+				Link:    atomLink{Href: url},
+				Summary: "Price: " + strconv.FormatFloat(p.Price, 'f', -1, 64),
+			})
+		}
+
+		respBody, err := xml.MarshalIndent(feed, "", "  ")
+		if err != nil {
+			EncodingErrorWithJSON(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(xml.Header))
+		w.Write(respBody)
+	}
+}
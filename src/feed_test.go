@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestProductsFeed(t *testing.T) {
+	var products []Product
+	for i, name := range []string{"Oldest", "Older", "Newest"} {
+		created := time.Now().Add(time.Duration(i-3) * time.Hour)
+		products = append(products, Product{ID: bson.NewObjectIdWithTime(created), Name: name, Price: 5})
+	}
+	store := newFakeStore(products...)
+
+	w := serve(store, "GET", "/products/feed.xml", "")
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/atom+xml") {
+		t.Errorf("Content-Type = %q", w.Header().Get("Content-Type"))
+	}
+	var feed atomFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("feed doesn't parse: %s\n%s", err, w.Body)
+	}
+
+	var titles []string
+	for _, entry := range feed.Entries {
+		titles = append(titles, entry.Title)
+	}
+	if fmt.Sprint(titles) != "[Newest Older Oldest]" {
+		t.Errorf("entries %v, want newest first", titles)
+	}
+	if feed.Author.Name == "" {
+		t.Errorf("feed has no author, which Atom requires when entries have none")
+	}
+	if feed.Updated != feed.Entries[0].Updated || feed.Entries[0].Updated != products[2].ID.Time().UTC().Format(time.RFC3339) {
+		t.Errorf("feed updated %s, newest entry %s, want the newest product's creation", feed.Updated, feed.Entries[0].Updated)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// A GeoJSON point. Coordinates are longitude then latitude.
+type GeoPoint struct {
+	Type        string    `json:"type" bson:"type"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+}
+
+// Returns an error unless lng and lat are valid coordinates
+func checkCoordinates(lng, lat float64) error {
+	if lng < -180 || lng > 180 {
+		return fmt.Errorf("longitude must be between -180 and 180")
+	}
+	if lat < -90 || lat > 90 {
+		return fmt.Errorf("latitude must be between -90 and 90")
+	}
+	return nil
+}
+
+// Returns an error unless p is a GeoJSON point with valid coordinates
+func validateLocation(p *GeoPoint) error {
+	if p.Type != "Point" || len(p.Coordinates) != 2 {
+		return fmt.Errorf("location must be a GeoJSON Point with [longitude, latitude] coordinates")
+	}
+	return checkCoordinates(p.Coordinates[0], p.Coordinates[1])
+}
+
+type geoFeature struct {
+	Type       string          `json:"type"`
+	ID         string          `json:"id"`
+	Geometry   *GeoPoint       `json:"geometry"`
+	Properties json.RawMessage `json:"properties"`
+}
+
+type geoFeatureCollection struct {
+	Type     string       `json:"type"`
+	Features []geoFeature `json:"features"`
+}
+
+// Returns the products located within ?max= meters of ?lng= and ?lat=,
+// nearest first, as a GeoJSON feature collection
+func getNearProducts(store ProductStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+
+		var coords [2]float64
+		for i, param := range []string{"lng", "lat"} {
+			v, err := strconv.ParseFloat(params.Get(param), 64)
+			if err != nil {
+				ErrorWithJSON(w, param+" must be a number", http.StatusBadRequest)
+				return
+			}
+			coords[i] = v
+		}
+		if err := checkCoordinates(coords[0], coords[1]); err != nil {
+			ErrorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Without a max distance the whole collection is in range
+		var max float64
+		if v := params.Get("max"); v != "" {
+			var err error
+			max, err = strconv.ParseFloat(v, 64)
+			if err != nil || max <= 0 {
+				ErrorWithJSON(w, "max must be a positive number of meters", http.StatusBadRequest)
+				return
+			}
+		}
+
+		limit, offset, err := paginate(r)
+		if err != nil {
+			ErrorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		products, err := store.Near(coords[0], coords[1], max, limit, offset)
+		if err != nil {
+			DatabaseErrorWithJSON(w, err)
+			log.Println("Failed get near products: ", err)
+			return
+		}
+		localize(r, products)
+
+		collection := geoFeatureCollection{Type: "FeatureCollection", Features: []geoFeature{}}
+		for i := range products {
+			properties, err := json.Marshal(&products[i])
+			if err != nil {
+				EncodingErrorWithJSON(w, err)
+				return
+			}
+			collection.Features = append(collection.Features, geoFeature{
+				Type:       "Feature",
+				ID:         products[i].ID.Hex(),
+				Geometry:   products[i].Location,
+				Properties: properties,
+			})
+		}
+
+		respBody, err := json.MarshalIndent(collection, "", "  ")
+		if err != nil {
+			EncodingErrorWithJSON(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/geo+json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBody)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Stores products at the given [longitude, latitude] points, nil for none
+func seedLocated(store *fakeStore, points map[string][]float64) {
+	for name, point := range points {
+		p := Product{Name: name, Price: 5}
+		if point != nil {
+			p.Location = &GeoPoint{Type: "Point", Coordinates: point}
+		}
+		store.Insert(&p)
+	}
+}
+
+func TestNearProducts(t *testing.T) {
+	store := newFakeStore()
+	seedLocated(store, map[string][]float64{
+		"Hamburg":  {9.99, 53.55},
+		"Potsdam":  {13.06, 52.39},
+		"Berlin":   {13.40, 52.52},
+		"Nowhere":  nil,
+		"Brussels": {4.35, 50.85},
+	})
+
+	for url, want := range map[string]string{
+		"/products/near?lng=13.38&lat=52.51&max=50000": "Berlin,Potsdam",
+		"/products/near?lng=13.38&lat=52.51":           "Berlin,Potsdam,Hamburg,Brussels",
+		"/products/near?lng=13.38&lat=52.51&limit=2":   "Berlin,Potsdam",
+	} {
+		w := serve(store, "GET", url, "")
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/geo+json") {
+			t.Errorf("%s: Content-Type %q", url, ct)
+		}
+		var collection struct {
+			Type     string `json:"type"`
+			Features []struct {
+				Type       string    `json:"type"`
+				ID         string    `json:"id"`
+				Geometry   *GeoPoint `json:"geometry"`
+				Properties Product   `json:"properties"`
+			} `json:"features"`
+		}
+		decode(t, w, &collection)
+
+		var names []string
+		for _, f := range collection.Features {
+			names = append(names, f.Properties.Name)
+			if f.Type != "Feature" || f.ID != f.Properties.ID.Hex() || f.Geometry == nil || f.Geometry.Type != "Point" || len(f.Geometry.Coordinates) != 2 {
+				t.Errorf("%s: malformed feature %+v", url, f)
+			}
+		}
+		if collection.Type != "FeatureCollection" || strings.Join(names, ",") != want {
+			t.Errorf("%s: %s listing %v, want a FeatureCollection of %s", url, collection.Type, names, want)
+		}
+	}
+}
+
+func TestNearProductsValidatesParams(t *testing.T) {
+	for _, query := range []string{
+		"lat=52.5",
+		"lng=abc&lat=52.5",
+		"lng=13.4",
+		"lng=181&lat=52.5",
+		"lng=13.4&lat=-91",
+		"lng=13.4&lat=52.5&max=0",
+		"lng=13.4&lat=52.5&max=far",
+	} {
+		w := serve(newFakeStore(), "GET", "/products/near?"+query, "")
+		var body map[string]string
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != http.StatusBadRequest || body["message"] == "" {
+			t.Errorf("%s: %d %s, want 400 with a message", query, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// When products were last created, by guard key
+var recentNames = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: map[string]time.Time{}}
+
+// Returns what near-identical names have in common: their search terms,
+// ignoring case and punctuation. Empty names aren't guarded and get "".
+func guardKey(name string) string {
+	return strings.Join(tokenize(name), " ")
+}
+
+// Returns how long until a product named name may be created, zero unless
+// one with a near-identical name was created within
+// config.CreateGuardWindow
+func createWait(name string) time.Duration {
+	key := guardKey(name)
+	if config.CreateGuardWindow <= 0 || key == "" {
+		return 0
+	}
+	now := time.Now()
+
+	recentNames.Lock()
+	defer recentNames.Unlock()
+
+	for k, created := range recentNames.m {
+		if now.Sub(created) >= config.CreateGuardWindow {
+			delete(recentNames.m, k)
+		}
+	}
+	if created, ok := recentNames.m[key]; ok {
+		return config.CreateGuardWindow - now.Sub(created)
+	}
+	return 0
+}
+
+// Records that a product named name was created. Call it only once the
+// product is stored, so failed creates can be retried at once.
+func recordCreate(name string) {
+	key := guardKey(name)
+	if config.CreateGuardWindow <= 0 || key == "" {
+		return
+	}
+
+	recentNames.Lock()
+	defer recentNames.Unlock()
+
+	recentNames.m[key] = time.Now()
+}
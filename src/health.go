@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// How long the health check waits for the database before reporting it
+// unavailable
+const HealthTimeout = 2 * time.Second
+
+// Reports whether the server can reach the database, for load balancers
+// and liveness probes
+func getHealth(store ProductStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := store.Ping(HealthTimeout); err != nil {
+			log.Println("Failed ping database: ", err)
+			ResponseWithJSON(w, []byte(`{"status":"unavailable"}`), http.StatusServiceUnavailable)
+			return
+		}
+		ResponseWithJSON(w, []byte(`{"status":"ok"}`), http.StatusOK)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// Makes requests carrying an Idempotency-Key header safe to retry. The
+// first request with a key runs h and its successful response is saved.
+// Retries with the key get that response replayed instead of applying the
+// request again. Failed responses aren't saved, so the retry runs. Reusing
+// a key for another request gets 422.
+func idempotent(store ProductStore, h func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			h(w, r)
+			return
+		}
+
+		// Only batch requests are made idempotent, so their cap applies
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(config.MaxBatchBytes)))
+		if err != nil {
+			bodyError(w, err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash := requestHash(r, body)
+
+		saved, err := store.ClaimKey(key, hash)
+		if err != nil {
+			DatabaseErrorWithJSON(w, err)
+			log.Println("Failed claim idempotency key: ", err)
+			return
+		}
+		if saved != nil {
+			// Keys saved before requests were fingerprinted have no hash
+			if saved.Hash != "" && saved.Hash != hash {
+				ErrorWithJSON(w, "This Idempotency-Key was used for another request", http.StatusUnprocessableEntity)
+				return
+			}
+			if saved.Pending {
+				ErrorWithJSON(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+				return
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			ResponseWithJSON(w, saved.Body, saved.Status)
+			return
+		}
+
+		response := &recordedResponse{header: http.Header{}}
+		func() {
+			// Free the key should h panic, or retries would find it pending
+			done := false
+			defer func() {
+				if !done {
+					store.ReleaseKey(key)
+				}
+			}()
+			h(response, r)
+			done = true
+		}()
+		if response.status == 0 {
+			response.status = http.StatusOK
+		}
+
+		if response.status >= 200 && response.status < 300 {
+			err = store.SaveResponse(key, &SavedResponse{Status: response.status, Body: response.body.Bytes()})
+			if err != nil {
+				log.Println("Failed save idempotent response: ", err)
+			}
+		}
+		if err != nil || response.status < 200 || response.status >= 300 {
+			if err := store.ReleaseKey(key); err != nil {
+				log.Println("Failed release idempotency key: ", err)
+			}
+		}
+
+		for name, values := range response.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(response.status)
+		w.Write(response.body.Bytes())
+	}
+}
+
+// Fingerprints a request by its method, path and body, so a key can't be
+// replayed to a different request
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
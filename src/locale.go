@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Returns the values of a quality weighted header such as Accept or
+// Accept-Language, most preferred first. Values with q=0 are dropped.
+func parseQualityList(header string) []string {
+	type tag struct {
+		name string
+		q    float64
+	}
+
+	var tags []tag
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+		}
+		if q > 0 {
+			tags = append(tags, tag{name, q})
+		}
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	names := make([]string, len(tags))
+	for i, t := range tags {
+		names[i] = t.name
+	}
+	return names
+}
+
+// Replaces the product name with the best match from its localized names,
+// trying each locale, then its primary language, then the default locale.
+// Without any of those the single name is kept.
+func localizeName(p *Product, locales []string) {
+	if len(p.Names) == 0 {
+		return
+	}
+
+	names := make(map[string]string, len(p.Names))
+	for locale, name := range p.Names {
+		names[strings.ToLower(locale)] = name
+	}
+
+	for _, locale := range locales {
+		if name, ok := names[locale]; ok {
+			p.Name = name
+			return
+		}
+		if i := strings.IndexByte(locale, '-'); i > 0 {
+			if name, ok := names[locale[:i]]; ok {
+				p.Name = name
+				return
+			}
+		}
+	}
+
+	if name, ok := names[strings.ToLower(config.DefaultLocale)]; ok {
+		p.Name = name
+	}
+}
+
+// Localizes the names of products for the request's Accept-Language
+func localize(r *http.Request, products []Product) {
+	locales := parseQualityList(r.Header.Get("Accept-Language"))
+	for i := range products {
+		localizeName(&products[i], locales)
+	}
+}
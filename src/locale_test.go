@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLocalizedNames(t *testing.T) {
+	defer func(locale string) { config.DefaultLocale = locale }(config.DefaultLocale)
+	store := newFakeStore(Product{Name: "Lamp (main)", Price: 5, Names: map[string]string{
+		"en": "Lamp", "de": "Lampe", "pt-BR": "Lâmpada", "fr": "Luminaire",
+	}})
+	id := store.sorted()[0].ID.Hex()
+
+	for _, c := range []struct {
+		defaultLocale, acceptLanguage, want string
+	}{
+		{"en", "de", "Lampe"},
+		{"en", "pt-br", "Lâmpada"},
+		{"en", "de-AT", "Lampe"},
+		{"en", "fr;q=0.5, de;q=0.9", "Lampe"},
+		{"en", "ja, fr;q=0.8", "Luminaire"},
+		{"en", "de;q=0, fr", "Luminaire"},
+		{"en", "ja", "Lamp"},
+		{"de", "ja", "Lampe"},
+		{"de", "", "Lampe"},
+		{"ja", "ko", "Lamp (main)"},
+	} {
+		config.DefaultLocale = c.defaultLocale
+		w := serveWithHeaders(store, "GET", "/products/"+id, "", map[string]string{"Accept-Language": c.acceptLanguage})
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+		var p Product
+		decode(t, w, &p)
+		if p.Name != c.want {
+			t.Errorf("Accept-Language %q, DEFAULT_LOCALE %s: name %q, want %q", c.acceptLanguage, c.defaultLocale, p.Name, c.want)
+		}
+	}
+}
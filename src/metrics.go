@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Histogram of write request body sizes in bytes, served on the admin
+// listener
+var bodySizes = newHistogram([]int64{1 << 8, 1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1 << 20})
+
+// A cumulative histogram
+type histogram struct {
+	mu     sync.Mutex
+	bounds []int64
+	counts []int64
+	count  int64
+	sum    int64
+}
+
+// Creates a histogram with the given upper bucket bounds
+func newHistogram(bounds []int64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+// Records one observation
+func (h *histogram) Observe(v int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Returns the histogram as JSON
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[string]int64, len(h.bounds)+1)
+	for i, bound := range h.bounds {
+		buckets[strconv.FormatInt(bound, 10)] = h.counts[i]
+	}
+	buckets["+Inf"] = h.count
+
+	data, _ := json.Marshal(struct {
+		Buckets map[string]int64 `json:"buckets"`
+		Count   int64            `json:"count"`
+		Sum     int64            `json:"sum"`
+	}{buckets, h.count, h.sum})
+	return string(data)
+}
+
+// Serves the metrics as JSON. Only the admin listener serves it, as
+// metrics aren't for API clients.
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	io.WriteString(w, `{"body_size_bytes": `+bodySizes.String()+"}")
+}
+
+// Counts the bytes read through it
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Records and logs the size of the body read by each write request, to
+// reveal clients sending abnormally large bodies
+func measureBodySize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		h.ServeHTTP(w, r)
+
+		bodySizes.Observe(body.n)
+		log.Printf("Request body %s %s: %d bytes", r.Method, r.URL.Path, body.n)
+	})
+}
+
+// Remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Logs one key=value access line per request with its method, path,
+// response status and duration
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		log.Printf("method=%s path=%q status=%d duration=%s",
+			r.Method, r.URL.Path, rec.status, time.Since(start))
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"html"
+	"log"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Converts prices stored as strings, from before price was numeric, to
+// numbers. Prices that don't parse are logged and left for manual fixing;
+// until then they read as 0.
+func migrateStringPrices(s *mgo.Session) {
+	session := s.Copy()
+	defer session.Close()
+
+	c := session.DB(config.Database).C(config.Collection)
+
+	var doc struct {
+		ID    bson.ObjectId `bson:"_id"`
+		Price string        `bson:"price"`
+	}
+	iter := c.Find(bson.M{"price": bson.M{"$type": "string"}}).Select(bson.M{"price": 1}).Iter()
+	for iter.Next(&doc) {
+		price, err := strconv.ParseFloat(strings.TrimSpace(doc.Price), 64)
+		if err != nil {
+			log.Printf("Failed migrate price %q of product %s: %s", doc.Price, doc.ID.Hex(), err)
+			continue
+		}
+
+		err = c.UpdateId(doc.ID, bson.M{"$set": bson.M{"price": price}})
+		if err != nil {
+			log.Printf("Failed migrate price of product %s: %s", doc.ID.Hex(), err)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		log.Println("Failed migrate string prices: ", err)
+	}
+}
+
+// Gives products stored before search terms were kept their keywords, so
+// ?q= finds them. Products without any terms get an empty list, so each is
+// only visited once.
+func backfillKeywords(s *mgo.Session) {
+	session := s.Copy()
+	defer session.Close()
+
+	c := session.DB(config.Database).C(config.Collection)
+
+	var p Product
+	iter := c.Find(bson.M{"keywords": bson.M{"$exists": false}}).Select(bson.M{"name": 1, "names": 1}).Iter()
+	for iter.Next(&p) {
+		// Keywords come from names as sent, before ESCAPE_HTML escapes them
+		if config.EscapeHTML {
+			p.Name = html.UnescapeString(p.Name)
+			for locale, name := range p.Names {
+				p.Names[locale] = html.UnescapeString(name)
+			}
+		}
+		terms := keywords(&p)
+		if terms == nil {
+			terms = []string{}
+		}
+
+		err := c.UpdateId(p.ID, bson.M{"$set": bson.M{"keywords": terms}})
+		if err != nil {
+			log.Printf("Failed backfill keywords of product %s: %s", p.ID.Hex(), err)
+		}
+		p = Product{}
+	}
+	if err := iter.Close(); err != nil {
+		log.Println("Failed backfill keywords: ", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Returns what a QR code for the product should encode: its canonical URL.
+// The request asked for a PNG image, but there's no QR encoder vendored, so
+// until one is the printing client renders the code from this payload.
+func getProductQR(store ProductStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := productId(w, r)
+		if !ok {
+			return
+		}
+
+		product, err := store.ByID(id, bson.M{"_id": 1})
+		if err != nil {
+			switch err {
+			default:
+				DatabaseErrorWithJSON(w, err)
+				log.Println("Failed find product: ", err)
+				return
+			case mgo.ErrNotFound:
+				ErrorWithJSON(w, "Product not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		respBody, err := json.MarshalIndent(struct {
+			Data string `json:"data"`
+		}{baseURL(r) + "/products/" + product.ID.Hex()}, "", "  ")
+		if err != nil {
+			EncodingErrorWithJSON(w, err)
+			return
+		}
+
+		ResponseWithJSON(w, respBody, http.StatusOK)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestProductQR(t *testing.T) {
+	store := newFakeStore()
+	products := seed(store, "Lamp")
+
+	w := serve(store, "GET", "/products/"+products[0].ID.Hex()+"/qr", "")
+	var payload struct {
+		Data string `json:"data"`
+	}
+	decode(t, w, &payload)
+	if want := "http://example.com/products/" + products[0].ID.Hex(); w.Code != http.StatusOK || payload.Data != want {
+		t.Errorf("status %d with data %q, want 200 with %q", w.Code, payload.Data, want)
+	}
+
+	if w := serve(store, "GET", "/products/"+bson.NewObjectId().Hex()+"/qr", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown id: status = %d, want 404", w.Code)
+	}
+}
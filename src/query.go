@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Fields clients may sort the product list on
+var sortableFields = map[string]bool{
+	"name":  true,
+	"price": true,
+}
+
+// A product list query as built from request params. The exported fields
+// are what ?explain=true reports.
+type listQuery struct {
+	Filter     bson.M   `json:"filter"`
+	Sort       []string `json:"sort"`
+	Projection bson.M   `json:"projection"`
+	Limit      int      `json:"limit"`
+	Skip       int      `json:"skip"`
+	Hint       string   `json:"hint,omitempty"`
+
+	// Requested ids, in the order results should be returned
+	ids []bson.ObjectId
+	// JSON fields to return, nil for full documents
+	fields []string
+	// Token of the snapshot being paged through, if any
+	snapshot string
+	// Whether the client filtered the products, as opposed to the filter
+	// only bounding a snapshot
+	filtered bool
+}
+
+// Builds the list query for the params of r. Errors describe the bad param
+// and are meant for the client.
+func buildListQuery(r *http.Request) (*listQuery, error) {
+	params := r.URL.Query()
+	q := &listQuery{Filter: bson.M{}, Sort: []string{}}
+
+	// Requested ids come back whole and in the order asked for. Paging or
+	// sorting would page on storage order and reorder the page after.
+	if v := params.Get("ids"); v != "" {
+		for _, param := range []string{"limit", "offset", "sort", "order"} {
+			if params.Get(param) != "" {
+				return nil, fmt.Errorf("Cannot use %s with ids", param)
+			}
+		}
+		for _, hex := range strings.Split(v, ",") {
+			if !bson.IsObjectIdHex(hex) {
+				return nil, fmt.Errorf("Invalid product id")
+			}
+			q.ids = append(q.ids, bson.ObjectIdHex(hex))
+		}
+		q.Filter["_id"] = bson.M{"$in": q.ids}
+	}
+
+	if v := params.Get("q"); v != "" {
+		terms := append([]string{}, tokenize(v)...)
+		q.Filter["keywords"] = bson.M{"$in": terms}
+	}
+
+	// Names are matched as literal substrings, so user input can't form an
+	// expensive pattern
+	if v := params.Get("name"); v != "" {
+		q.Filter["name"] = bson.RegEx{Pattern: regexp.QuoteMeta(v), Options: "i"}
+	}
+
+	price := bson.M{}
+	for _, bound := range []struct{ param, op string }{{"minPrice", "$gte"}, {"maxPrice", "$lte"}} {
+		v := params.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		limit, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(limit) || math.IsInf(limit, 0) {
+			return nil, fmt.Errorf("%s must be a number", bound.param)
+		}
+		price[bound.op] = limit
+	}
+	if len(price) > 0 {
+		q.Filter["price"] = price
+	}
+
+	q.filtered = len(q.Filter) > 0
+
+	// A snapshot holds the products created before it was taken, which
+	// their ObjectIds tell. ?snapshot=new takes one, and passing its token
+	// on later pages keeps them from shifting as products are added.
+	if v := params.Get("snapshot"); v != "" {
+		taken := time.Now().Unix()
+		if v != "new" {
+			var err error
+			if taken, err = strconv.ParseInt(v, 10, 64); err != nil || taken <= 0 {
+				return nil, fmt.Errorf("Invalid snapshot token")
+			}
+		}
+		q.snapshot = strconv.FormatInt(taken, 10)
+
+		before := bson.NewObjectIdWithTime(time.Unix(taken, 0))
+		if ids, ok := q.Filter["_id"].(bson.M); ok {
+			ids["$lt"] = before
+		} else {
+			q.Filter["_id"] = bson.M{"$lt": before}
+		}
+	}
+
+	// The first configured hint for a filtered field wins
+	for _, hint := range config.IndexHints {
+		if _, ok := q.Filter[hint.Field]; ok {
+			q.Hint = hint.Index
+			break
+		}
+	}
+
+	if v := params.Get("sort"); v != "" {
+		if !sortableFields[strings.TrimPrefix(v, "-")] {
+			return nil, fmt.Errorf("Cannot sort on %q", v)
+		}
+		q.Sort = append(q.Sort, v)
+	}
+
+	// ObjectIds embed their creation time, so ordering on _id
+	// is ordering by creation
+	switch params.Get("order") {
+	case "":
+	case "newest":
+		q.Sort = append(q.Sort, "-_id")
+	case "oldest":
+		q.Sort = append(q.Sort, "_id")
+	default:
+		return nil, fmt.Errorf("Order must be newest or oldest")
+	}
+
+	var err error
+	q.Limit, q.Skip, err = paginate(r)
+	if err != nil {
+		return nil, err
+	}
+	if q.ids != nil {
+		q.Limit = 0
+	}
+
+	fields, err := viewFields(r)
+	if err != nil {
+		return nil, err
+	}
+	q.fields = fields
+	q.Projection = projection(fields)
+
+	return q, nil
+}
+
+// Returns the mgo query for q on collection c
+func (q *listQuery) apply(c *mgo.Collection) *mgo.Query {
+	query := c.Find(q.Filter)
+	if len(q.Sort) > 0 {
+		query = query.Sort(q.Sort...)
+	}
+	if q.Hint != "" {
+		query = query.Hint(q.Hint)
+	}
+	if q.Projection != nil {
+		query = query.Select(q.Projection)
+	}
+	if q.Skip > 0 {
+		query = query.Skip(q.Skip)
+	}
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+	return query
+}
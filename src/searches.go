@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"goji.io/pat"
+	"gopkg.in/mgo.v2"
+)
+
+// List params a saved search may set. Paging, sorting and fields are left
+// to each run.
+var searchParams = map[string]bool{
+	"ids":      true,
+	"q":        true,
+	"name":     true,
+	"minPrice": true,
+	"maxPrice": true,
+}
+
+// Returns an error unless params are list filters buildListQuery accepts
+func validateSearch(params map[string]string) error {
+	values := url.Values{}
+	for param, v := range params {
+		if !searchParams[param] {
+			return fmt.Errorf("Searches can't set %q", param)
+		}
+		values.Set(param, v)
+	}
+	_, err := buildListQuery(&http.Request{URL: &url.URL{RawQuery: values.Encode()}})
+	return err
+}
+
+// Saves the list filters in the body, an object of param to value, as the
+// search named in the path, replacing any search of that name
+func saveSearch(store ProductStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var params map[string]string
+		err := json.NewDecoder(r.Body).Decode(&params)
+		if err != nil {
+			ErrorWithJSON(w, "Incorrect body", http.StatusBadRequest)
+			return
+		}
+
+		if err := validateSearch(params); err != nil {
+			ErrorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = store.SaveSearch(pat.Param(r, "name"), params)
+		if err != nil {
+			DatabaseErrorWithJSON(w, err)
+			log.Println("Failed save search: ", err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Lists the products matching the search named in the path, as
+// GET /products would with the saved filters. The request's own params
+// page, sort and project the results.
+func getSearchResults(store ProductStore) func(w http.ResponseWriter, r *http.Request) {
+	list := listProducts(store, false)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, err := store.Search(pat.Param(r, "name"))
+		if err != nil {
+			switch err {
+			default:
+				DatabaseErrorWithJSON(w, err)
+				log.Println("Failed find search: ", err)
+				return
+			case mgo.ErrNotFound:
+				ErrorWithJSON(w, "Search not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		// The saved filters replace any the request has
+		values := r.URL.Query()
+		for param := range searchParams {
+			values.Del(param)
+		}
+		for param, v := range params {
+			values.Set(param, v)
+		}
+
+		u := *r.URL
+		u.RawQuery = values.Encode()
+		run := *r
+		run.URL = &u
+		list(w, &run)
+	}
+}
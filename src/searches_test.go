@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSavedSearch(t *testing.T) {
+	store := newFakeStore()
+	seed(store, "A", "B", "C", "D", "E", "F")
+
+	if w := serve(store, "PUT", "/searches/pricey", `{"minPrice": "30"}`); w.Code != http.StatusNoContent {
+		t.Fatalf("save: status = %d, want 204: %s", w.Code, w.Body)
+	}
+
+	// The saved minPrice replaces the request's, which orders and pages
+	var products []Product
+	decode(t, serve(store, "GET", "/searches/pricey/results?minPrice=55&order=newest&limit=2", ""), &products)
+	if len(products) != 2 || products[0].Price != 60 || products[1].Price != 50 {
+		t.Errorf("results %+v, want the two newest from 30 up", products)
+	}
+
+	if w := serve(store, "GET", "/searches/missing/results", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown search: status = %d, want 404", w.Code)
+	}
+}
+
+func TestSaveSearchValidates(t *testing.T) {
+	store := newFakeStore()
+
+	for _, body := range []string{`{"limit": "5"}`, `{"sort": "price"}`, `{"minPrice": "cheap"}`, `["q"]`} {
+		if w := serve(store, "PUT", "/searches/bad", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, w.Code)
+		}
+	}
+	if _, err := store.Search("bad"); err == nil {
+		t.Errorf("a rejected search was saved")
+	}
+}
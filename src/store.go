@@ -0,0 +1,466 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Persistence of products. Handlers only go through this interface, so
+// tests can swap mongoStore for an in-memory fake. Lookups of a missing
+// product return mgo.ErrNotFound, and writes breaking a unique index
+// return an error mgo.IsDup recognizes.
+type ProductStore interface {
+	// Returns the products matching q, and how many match ignoring paging
+	All(q *listQuery) ([]Product, int, error)
+	// Returns products where any of the fields is absent or empty
+	Incomplete(fields []string, limit, offset int) ([]Product, error)
+	// Returns the n most viewed products
+	Popular(n int) ([]Product, error)
+	// Returns the n most recently added products, newest first
+	Newest(n int) ([]Product, error)
+	// Splits the prices of the products matching filter into at most n
+	// ranges holding about as many products each
+	PriceBuckets(filter bson.M, n int) ([]PriceBucket, error)
+	// Returns products located within max meters of lng and lat, or at any
+	// distance when max is 0, nearest first
+	Near(lng, lat, max float64, limit, offset int) ([]Product, error)
+	// Returns the product with the given id, loading only the projected
+	// fields unless projection is nil
+	ByID(id bson.ObjectId, projection bson.M) (Product, error)
+	// Records a view of the product with the given id
+	CountView(id bson.ObjectId)
+	// Assigns an id and a product number and stores a new product
+	Insert(p *Product) error
+	// Assigns ids and product numbers to products and stores them in one
+	// write. Returns for each product the error storing it, or nil.
+	InsertAll(products []Product) ([]error, error)
+	// Stores p under its id unless a product with that id exists, and then
+	// assigns it a product number. Reports whether p was stored.
+	Upsert(p *Product) (bool, error)
+	// Sets the client fields of the product with the given id and
+	// increments its version. Unless expected is negative, fails with
+	// ErrVersionConflict when the product is at another version.
+	Update(id bson.ObjectId, p *Product, expected int) error
+	// Removes the product with the given id
+	Delete(id bson.ObjectId) error
+	// Removes the products matching filter and returns how many there were
+	DeleteAll(filter bson.M) (int, error)
+	// Returns the id of the stored product a duplicate write of p collided
+	// with, or "" if it can't be told
+	ConflictingID(p *Product) (bson.ObjectId, error)
+	// Saves the list params of a named search, replacing any of that name
+	SaveSearch(name string, params map[string]string) error
+	// Returns the list params of the named search
+	Search(name string) (map[string]string, error)
+	// Claims an idempotency key for a request fingerprinted by hash.
+	// Returns nil if the key was free or its pending claim outlived
+	// config.IdempotencyLease, or else the response saved for it, which is
+	// pending while the request holding the key is still running.
+	ClaimKey(key, hash string) (*SavedResponse, error)
+	// Saves the response of the request holding key
+	SaveResponse(key string, response *SavedResponse) error
+	// Frees key so that the request can be retried
+	ReleaseKey(key string) error
+	// Checks the database can be reached, giving up after timeout
+	Ping(timeout time.Duration) error
+}
+
+// A range of prices, from Min up to Max, and how many products are in it.
+// Max is exclusive except in the last bucket.
+type PriceBucket struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+// Returned by updates expecting another version than the stored one
+var ErrVersionConflict = errors.New("product version conflict")
+
+// A response stored for replay to retries of an idempotent request
+type SavedResponse struct {
+	Pending bool `bson:"pending"`
+	// Fingerprint of the request that claimed the key
+	Hash    string    `bson:"hash,omitempty"`
+	Created time.Time `bson:"created,omitempty"`
+	Status  int       `bson:"status,omitempty"`
+	Body    []byte    `bson:"body,omitempty"`
+}
+
+// ProductStore backed by MongoDB
+type mongoStore struct {
+	session *mgo.Session
+}
+
+// Returns a store using copies of session
+func newMongoStore(session *mgo.Session) *mongoStore {
+	return &mongoStore{session: session}
+}
+
+// Returns a copy of the store's session and its products collection. The
+// session must be closed by the caller.
+func (s *mongoStore) products() (*mgo.Session, *mgo.Collection) {
+	session := s.session.Copy()
+	return session, session.DB(config.Database).C(config.Collection)
+}
+
+// Runs the read fn on the products collection, falling back to a
+// secondary as fallbackRead decides.
+func (s *mongoStore) read(what string, fn func(c *mgo.Collection) error) error {
+	session, c := s.products()
+	defer session.Close()
+
+	return fallbackRead(what, func() error { return fn(c) }, func() error {
+		secondary := s.session.Copy()
+		defer secondary.Close()
+		secondary.SetMode(mgo.Secondary, true)
+		return fn(secondary.DB(config.Database).C(config.Collection))
+	})
+}
+
+// Runs primary. When it fails and config.SecondaryFallback is set,
+// secondary is run instead, which may return data that is slightly behind
+// the primary. A missing document is not a failure.
+func fallbackRead(what string, primary, secondary func() error) error {
+	err := primary()
+	if err == nil || err == mgo.ErrNotFound || !config.SecondaryFallback {
+		return err
+	}
+	log.Printf("Failed %s on primary, retrying on a secondary: %s", what, err)
+	return secondary()
+}
+
+func (s *mongoStore) All(q *listQuery) ([]Product, int, error) {
+	var products []Product
+	var total int
+	err := s.read("list products", func(c *mgo.Collection) error {
+		var err error
+		if total, err = c.Find(q.Filter).Count(); err != nil {
+			return err
+		}
+		products = nil
+		return q.apply(c).All(&products)
+	})
+	return products, total, err
+}
+
+func (s *mongoStore) Incomplete(fields []string, limit, offset int) ([]Product, error) {
+	var missing []bson.M
+	for _, field := range fields {
+		missing = append(missing,
+			bson.M{field: bson.M{"$exists": false}},
+			bson.M{field: bson.M{"$in": []interface{}{nil, ""}}})
+	}
+
+	products := []Product{}
+	err := s.read("list incomplete products", func(c *mgo.Collection) error {
+		return c.Find(bson.M{"$or": missing}).Sort("_id").Skip(offset).Limit(limit).All(&products)
+	})
+	return products, err
+}
+
+func (s *mongoStore) Popular(n int) ([]Product, error) {
+	products := []Product{}
+	err := s.read("list popular products", func(c *mgo.Collection) error {
+		return c.Find(bson.M{"views": bson.M{"$gt": 0}}).Sort("-views").Limit(n).All(&products)
+	})
+	return products, err
+}
+
+func (s *mongoStore) Newest(n int) ([]Product, error) {
+	var products []Product
+	err := s.read("list newest products", func(c *mgo.Collection) error {
+		return c.Find(nil).Sort("-_id").Limit(n).All(&products)
+	})
+	return products, err
+}
+
+func (s *mongoStore) PriceBuckets(filter bson.M, n int) ([]PriceBucket, error) {
+	var results []struct {
+		ID struct {
+			Min float64 `bson:"min"`
+			Max float64 `bson:"max"`
+		} `bson:"_id"`
+		Count int `bson:"count"`
+	}
+	err := s.read("bucket prices", func(c *mgo.Collection) error {
+		return c.Pipe([]bson.M{
+			{"$match": filter},
+			// Left over string prices would otherwise get buckets of their own
+			{"$match": bson.M{"price": bson.M{"$type": "number"}}},
+			{"$bucketAuto": bson.M{"groupBy": "$price", "buckets": n}},
+		}).All(&results)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]PriceBucket, len(results))
+	for i, result := range results {
+		buckets[i] = PriceBucket{Min: result.ID.Min, Max: result.ID.Max, Count: result.Count}
+	}
+	return buckets, nil
+}
+
+func (s *mongoStore) Near(lng, lat, max float64, limit, offset int) ([]Product, error) {
+	near := bson.M{"$geometry": GeoPoint{Type: "Point", Coordinates: []float64{lng, lat}}}
+	if max > 0 {
+		near["$maxDistance"] = max
+	}
+
+	products := []Product{}
+	err := s.read("list near products", func(c *mgo.Collection) error {
+		return c.Find(bson.M{"location": bson.M{"$near": near}}).Skip(offset).Limit(limit).All(&products)
+	})
+	return products, err
+}
+
+func (s *mongoStore) ByID(id bson.ObjectId, projection bson.M) (Product, error) {
+	var product Product
+	err := s.read("find product", func(c *mgo.Collection) error {
+		return c.FindId(id).Select(projection).One(&product)
+	})
+	return product, err
+}
+
+func (s *mongoStore) CountView(id bson.ObjectId) {
+	session := s.session.Copy()
+	defer session.Close()
+
+	countView(session, id)
+}
+
+// Assigns the next product number to p
+func (s *mongoStore) number(session *mgo.Session, p *Product) error {
+	var err error
+	p.Number, err = nextSequence(session.DB(config.Database).C(Counters), config.Collection, 1)
+	return err
+}
+
+func (s *mongoStore) Insert(p *Product) error {
+	session, c := s.products()
+	defer session.Close()
+
+	if err := s.number(session, p); err != nil {
+		return err
+	}
+	p.ID = bson.NewObjectId()
+	return c.Insert(p)
+}
+
+// Numbers products in order with the block of sequence values ending at
+// last
+func numberBlock(products []Product, last int) {
+	for i := range products {
+		products[i].Number = last - len(products) + 1 + i
+	}
+}
+
+func (s *mongoStore) InsertAll(products []Product) ([]error, error) {
+	session, c := s.products()
+	defer session.Close()
+
+	// Reserve a block of numbers in one round trip
+	last, err := nextSequence(session.DB(config.Database).C(Counters), config.Collection, len(products))
+	if err != nil {
+		return nil, err
+	}
+
+	bulk := c.Bulk()
+	bulk.Unordered()
+	numberBlock(products, last)
+	for i := range products {
+		products[i].ID = bson.NewObjectId()
+		bulk.Insert(&products[i])
+	}
+
+	errs := make([]error, len(products))
+	_, err = bulk.Run()
+	if berr, ok := err.(*mgo.BulkError); ok {
+		for _, failure := range berr.Cases() {
+			if failure.Index < 0 || failure.Index >= len(products) {
+				return nil, err
+			}
+			errs[failure.Index] = failure.Err
+		}
+		err = nil
+	}
+	return errs, err
+}
+
+func (s *mongoStore) Upsert(p *Product) (bool, error) {
+	session, c := s.products()
+	defer session.Close()
+
+	// The id is set from the query on insert. The number is only taken once
+	// the upsert inserted, so retries of a create don't use up numbers.
+	insert := *p
+	insert.ID, insert.Number = "", 0
+	info, err := c.UpsertId(p.ID, bson.M{"$setOnInsert": &insert})
+	if err != nil || info.UpsertedId == nil {
+		return false, err
+	}
+
+	if err := s.number(session, p); err != nil {
+		return true, err
+	}
+	return true, c.UpdateId(p.ID, bson.M{"$set": bson.M{"number": p.Number}})
+}
+
+func (s *mongoStore) Update(id bson.ObjectId, p *Product, expected int) error {
+	session, c := s.products()
+	defer session.Close()
+
+	selector := bson.M{"_id": id}
+	switch {
+	case expected == 0:
+		// A missing version is version 0, and null matches missing fields
+		selector["version"] = bson.M{"$in": []interface{}{0, nil}}
+	case expected > 0:
+		selector["version"] = expected
+	}
+
+	err := c.Update(selector, bson.M{"$set": p, "$inc": bson.M{"version": 1}})
+	if err != mgo.ErrNotFound || expected < 0 {
+		return err
+	}
+
+	// Tell a missing product from one at another version
+	n, err := c.FindId(id).Count()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrVersionConflict
+	}
+	return mgo.ErrNotFound
+}
+
+func (s *mongoStore) Delete(id bson.ObjectId) error {
+	session, c := s.products()
+	defer session.Close()
+
+	return c.RemoveId(id)
+}
+
+func (s *mongoStore) DeleteAll(filter bson.M) (int, error) {
+	session, c := s.products()
+	defer session.Close()
+
+	info, err := c.RemoveAll(filter)
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+func (s *mongoStore) ConflictingID(p *Product) (bson.ObjectId, error) {
+	// The unique keys are the id and the name
+	var keys []bson.M
+	if p.ID != "" {
+		keys = append(keys, bson.M{"_id": p.ID})
+	}
+	if p.Name != "" {
+		keys = append(keys, bson.M{"name": p.Name})
+	}
+	if keys == nil {
+		return "", nil
+	}
+
+	session, c := s.products()
+	defer session.Close()
+
+	var existing Product
+	err := c.Find(bson.M{"$or": keys}).Select(bson.M{"_id": 1}).One(&existing)
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return existing.ID, err
+}
+
+func (s *mongoStore) Ping(timeout time.Duration) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	session.SetSyncTimeout(timeout)
+	session.SetSocketTimeout(timeout)
+	return session.Ping()
+}
+
+// Returns a copy of the store's session and its saved searches collection.
+// The session must be closed by the caller.
+func (s *mongoStore) searches() (*mgo.Session, *mgo.Collection) {
+	session := s.session.Copy()
+	return session, session.DB(config.Database).C(Searches)
+}
+
+func (s *mongoStore) SaveSearch(name string, params map[string]string) error {
+	session, c := s.searches()
+	defer session.Close()
+
+	_, err := c.UpsertId(name, bson.M{"$set": bson.M{"params": params}})
+	return err
+}
+
+func (s *mongoStore) Search(name string) (map[string]string, error) {
+	session, c := s.searches()
+	defer session.Close()
+
+	var search struct {
+		Params map[string]string `bson:"params"`
+	}
+	err := c.FindId(name).One(&search)
+	return search.Params, err
+}
+
+// Returns a copy of the store's session and its idempotency keys
+// collection. The session must be closed by the caller.
+func (s *mongoStore) keys() (*mgo.Session, *mgo.Collection) {
+	session := s.session.Copy()
+	return session, session.DB(config.Database).C(IdempotencyKeys)
+}
+
+func (s *mongoStore) ClaimKey(key, hash string) (*SavedResponse, error) {
+	session, c := s.keys()
+	defer session.Close()
+
+	err := c.Insert(bson.M{"_id": key, "pending": true, "hash": hash, "created": time.Now()})
+	if !mgo.IsDup(err) {
+		return nil, err
+	}
+
+	var saved SavedResponse
+	err = c.FindId(key).One(&saved)
+	if err == mgo.ErrNotFound {
+		// Released or expired since, so claim it again
+		return s.ClaimKey(key, hash)
+	}
+	if err == nil && saved.Pending && time.Since(saved.Created) > config.IdempotencyLease {
+		// The request holding the key died without releasing it. Take the
+		// claim over unless another retry just did.
+		err = c.Update(bson.M{"_id": key, "pending": true, "created": saved.Created},
+			bson.M{"$set": bson.M{"hash": hash, "created": time.Now()}})
+		if err == mgo.ErrNotFound {
+			return s.ClaimKey(key, hash)
+		}
+		return nil, err
+	}
+	return &saved, err
+}
+
+func (s *mongoStore) SaveResponse(key string, response *SavedResponse) error {
+	session, c := s.keys()
+	defer session.Close()
+
+	return c.UpdateId(key, bson.M{"$set": response})
+}
+
+func (s *mongoStore) ReleaseKey(key string) error {
+	session, c := s.keys()
+	defer session.Close()
+
+	return c.RemoveId(key)
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// In-memory ProductStore for handler tests. It enforces the unique name
+// index and understands the filters buildListQuery generates.
+type fakeStore struct {
+	mu       sync.Mutex
+	products map[bson.ObjectId]Product
+	number   int
+	searches map[string]map[string]string
+	keys     map[string]*SavedResponse
+	// Returned by every call when set
+	err error
+	// Returned by SaveResponse when set
+	saveErr error
+	// Buckets the last PriceBuckets call was asked for
+	bucketsAsked int
+}
+
+func newFakeStore(products ...Product) *fakeStore {
+	s := &fakeStore{
+		products: map[bson.ObjectId]Product{},
+		searches: map[string]map[string]string{},
+		keys:     map[string]*SavedResponse{},
+	}
+	for _, p := range products {
+		if p.ID == "" {
+			p.ID = bson.NewObjectId()
+		}
+		s.products[p.ID] = p
+	}
+	return s
+}
+
+// The error a write breaking a unique index gets from mgo
+var errDup = &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}
+
+// Returns the stored products ordered by id, which is creation order
+func (s *fakeStore) sorted() []Product {
+	products := make([]Product, 0, len(s.products))
+	for _, p := range s.products {
+		products = append(products, p)
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].ID < products[j].ID })
+	return products
+}
+
+// Reports whether p matches filter. Panics on filters it doesn't know, so
+// tests notice when the query builder grows.
+func matches(p *Product, filter bson.M) bool {
+	for field, cond := range filter {
+		switch field {
+		case "_id":
+			for op, v := range cond.(bson.M) {
+				switch op {
+				case "$in":
+					found := false
+					for _, id := range v.([]bson.ObjectId) {
+						found = found || id == p.ID
+					}
+					if !found {
+						return false
+					}
+				case "$lt":
+					if p.ID >= v.(bson.ObjectId) {
+						return false
+					}
+				default:
+					panic("fake store can't match _id " + op)
+				}
+			}
+		case "keywords":
+			found := false
+			for _, term := range cond.(bson.M)["$in"].([]string) {
+				for _, keyword := range p.Keywords {
+					found = found || term == keyword
+				}
+			}
+			if !found {
+				return false
+			}
+		case "name":
+			if !regexp.MustCompile("(?i)" + cond.(bson.RegEx).Pattern).MatchString(p.Name) {
+				return false
+			}
+		case "price":
+			for op, v := range cond.(bson.M) {
+				switch op {
+				case "$gte":
+					if p.Price < v.(float64) {
+						return false
+					}
+				case "$lte":
+					if p.Price > v.(float64) {
+						return false
+					}
+				default:
+					panic("fake store can't match price " + op)
+				}
+			}
+		default:
+			panic("fake store can't match " + field)
+		}
+	}
+	return true
+}
+
+// Reports whether a stored product other than the one with id is named
+// name
+func (s *fakeStore) nameTaken(name string, id bson.ObjectId) bool {
+	if name == "" {
+		return false
+	}
+	for _, p := range s.products {
+		if p.Name == name && p.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fakeStore) All(q *listQuery) ([]Product, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, 0, s.err
+	}
+
+	var matching []Product
+	for _, p := range s.sorted() {
+		if matches(&p, q.Filter) {
+			matching = append(matching, p)
+		}
+	}
+	for _, key := range q.Sort {
+		if key == "-_id" {
+			for i, j := 0, len(matching)-1; i < j; i, j = i+1, j-1 {
+				matching[i], matching[j] = matching[j], matching[i]
+			}
+		}
+	}
+
+	total := len(matching)
+	if q.Skip < len(matching) {
+		matching = matching[q.Skip:]
+	} else {
+		matching = nil
+	}
+	if q.Limit > 0 && q.Limit < len(matching) {
+		matching = matching[:q.Limit]
+	}
+	return matching, total, nil
+}
+
+func (s *fakeStore) Incomplete(fields []string, limit, offset int) ([]Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	// As the $or of $exists and $in [null, ""] on the stored document
+	products := []Product{}
+	for _, p := range s.sorted() {
+		var doc bson.M
+		data, _ := bson.Marshal(&p)
+		bson.Unmarshal(data, &doc)
+		for _, field := range fields {
+			if v, ok := doc[field]; !ok || v == nil || v == "" {
+				products = append(products, p)
+				break
+			}
+		}
+	}
+
+	if offset < len(products) {
+		products = products[offset:]
+	} else {
+		products = []Product{}
+	}
+	if limit > 0 && limit < len(products) {
+		products = products[:limit]
+	}
+	return products, nil
+}
+
+func (s *fakeStore) Popular(n int) ([]Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	products := []Product{}
+	for _, p := range s.sorted() {
+		if p.Views > 0 {
+			products = append(products, p)
+		}
+	}
+	sort.SliceStable(products, func(i, j int) bool { return products[i].Views > products[j].Views })
+	if len(products) > n {
+		products = products[:n]
+	}
+	return products, nil
+}
+
+func (s *fakeStore) Newest(n int) ([]Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	products := s.sorted()
+	for i, j := 0, len(products)-1; i < j; i, j = i+1, j-1 {
+		products[i], products[j] = products[j], products[i]
+	}
+	if len(products) > n {
+		products = products[:n]
+	}
+	return products, nil
+}
+
+// Groups the prices of matching products into up to n buckets of about
+// equal counts, as $bucketAuto does
+func (s *fakeStore) PriceBuckets(filter bson.M, n int) ([]PriceBucket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.bucketsAsked = n
+
+	var prices []float64
+	for _, p := range s.products {
+		if matches(&p, filter) {
+			prices = append(prices, p.Price)
+		}
+	}
+	sort.Float64s(prices)
+
+	buckets := []PriceBucket{}
+	per := (len(prices) + n - 1) / n
+	for i := 0; i < len(prices); i += per {
+		end := i + per
+		if end > len(prices) {
+			end = len(prices)
+		}
+		max := prices[end-1]
+		if end < len(prices) {
+			max = prices[end]
+		}
+		buckets = append(buckets, PriceBucket{Min: prices[i], Max: max, Count: end - i})
+	}
+	return buckets, nil
+}
+
+// Returns the great circle distance in meters between two points, as
+// 2dsphere queries measure it
+func distance(lng1, lat1, lng2, lat2 float64) float64 {
+	const earthRadius = 6378100
+	rad := math.Pi / 180
+	dLat, dLng := (lat2-lat1)*rad, (lng2-lng1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+func (s *fakeStore) Near(lng, lat, max float64, limit, offset int) ([]Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	away := func(p *Product) float64 {
+		return distance(lng, lat, p.Location.Coordinates[0], p.Location.Coordinates[1])
+	}
+	products := []Product{}
+	for _, p := range s.sorted() {
+		if p.Location != nil && (max <= 0 || away(&p) <= max) {
+			products = append(products, p)
+		}
+	}
+	sort.SliceStable(products, func(i, j int) bool { return away(&products[i]) < away(&products[j]) })
+
+	if offset < len(products) {
+		products = products[offset:]
+	} else {
+		products = []Product{}
+	}
+	if limit > 0 && limit < len(products) {
+		products = products[:limit]
+	}
+	return products, nil
+}
+
+func (s *fakeStore) ByID(id bson.ObjectId, projection bson.M) (Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return Product{}, s.err
+	}
+
+	p, ok := s.products[id]
+	if !ok {
+		return Product{}, mgo.ErrNotFound
+	}
+	return p, nil
+}
+
+func (s *fakeStore) CountView(id bson.ObjectId) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.products[id]; ok {
+		p.Views++
+		s.products[id] = p
+	}
+}
+
+func (s *fakeStore) Insert(p *Product) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	if s.nameTaken(p.Name, "") {
+		return errDup
+	}
+	s.number++
+	p.Number = s.number
+	p.ID = bson.NewObjectId()
+	s.products[p.ID] = *p
+	return nil
+}
+
+func (s *fakeStore) InsertAll(products []Product) ([]error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	// As Mongo's, numbers are reserved for the whole batch, failures too
+	s.number += len(products)
+	numberBlock(products, s.number)
+	errs := make([]error, len(products))
+	for i := range products {
+		if s.nameTaken(products[i].Name, "") {
+			errs[i] = errDup
+			continue
+		}
+		products[i].ID = bson.NewObjectId()
+		s.products[products[i].ID] = products[i]
+	}
+	return errs, nil
+}
+
+func (s *fakeStore) Upsert(p *Product) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return false, s.err
+	}
+
+	if _, ok := s.products[p.ID]; ok {
+		return false, nil
+	}
+	if s.nameTaken(p.Name, p.ID) {
+		return false, errDup
+	}
+	s.number++
+	p.Number = s.number
+	s.products[p.ID] = *p
+	return true, nil
+}
+
+func (s *fakeStore) Update(id bson.ObjectId, p *Product, expected int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	stored, ok := s.products[id]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	if expected >= 0 && stored.Version != expected {
+		return ErrVersionConflict
+	}
+	if s.nameTaken(p.Name, id) {
+		return errDup
+	}
+
+	// As $set does, replacing the fields bson doesn't omit when empty
+	stored.Name, stored.Price, stored.Names, stored.Discount = p.Name, p.Price, p.Names, p.Discount
+	if p.Keywords != nil {
+		stored.Keywords = p.Keywords
+	}
+	if p.Location != nil {
+		stored.Location = p.Location
+	}
+	stored.Version++
+	s.products[id] = stored
+	return nil
+}
+
+func (s *fakeStore) Delete(id bson.ObjectId) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	if _, ok := s.products[id]; !ok {
+		return mgo.ErrNotFound
+	}
+	delete(s.products, id)
+	return nil
+}
+
+func (s *fakeStore) DeleteAll(filter bson.M) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	deleted := 0
+	for id, p := range s.products {
+		if matches(&p, filter) {
+			delete(s.products, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *fakeStore) ConflictingID(p *Product) (bson.ObjectId, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.products[p.ID]; ok {
+		return p.ID, nil
+	}
+	for _, stored := range s.products {
+		if p.Name != "" && stored.Name == p.Name {
+			return stored.ID, nil
+		}
+	}
+	return "", nil
+}
+
+func (s *fakeStore) SaveSearch(name string, params map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.searches[name] = params
+	return s.err
+}
+
+func (s *fakeStore) Search(name string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	params, ok := s.searches[name]
+	if !ok {
+		return nil, mgo.ErrNotFound
+	}
+	return params, s.err
+}
+
+func (s *fakeStore) ClaimKey(key, hash string) (*SavedResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	if saved, ok := s.keys[key]; ok && !(saved.Pending && time.Since(saved.Created) > config.IdempotencyLease) {
+		copy := *saved
+		return &copy, nil
+	}
+	s.keys[key] = &SavedResponse{Pending: true, Hash: hash, Created: time.Now()}
+	return nil, nil
+}
+
+func (s *fakeStore) SaveResponse(key string, response *SavedResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	if s.saveErr != nil {
+		return s.saveErr
+	}
+	stored, ok := s.keys[key]
+	if !ok {
+		return mgo.ErrNotFound
+	}
+	// As $set does, keeping the fields response omits
+	saved := *stored
+	saved.Pending, saved.Status, saved.Body = response.Pending, response.Status, response.Body
+	s.keys[key] = &saved
+	return nil
+}
+
+func (s *fakeStore) ReleaseKey(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, key)
+	return nil
+}
+
+func (s *fakeStore) Ping(timeout time.Duration) error {
+	return s.err
+}
+
+func TestFallbackRead(t *testing.T) {
+	defer func(old bool) { config.SecondaryFallback = old }(config.SecondaryFallback)
+	down := errors.New("no reachable servers")
+
+	cases := []struct {
+		fallback   bool
+		primaryErr error
+		want       error
+		secondary  bool
+	}{
+		{true, nil, nil, false},
+		{true, mgo.ErrNotFound, mgo.ErrNotFound, false},
+		{true, down, nil, true},
+		{false, down, down, false},
+	}
+	for _, c := range cases {
+		config.SecondaryFallback = c.fallback
+		ranSecondary := false
+		err := fallbackRead("test read", func() error { return c.primaryErr }, func() error {
+			ranSecondary = true
+			return nil
+		})
+		if err != c.want || ranSecondary != c.secondary {
+			t.Errorf("fallback %v, primary error %v: got %v, secondary run %v; want %v, %v",
+				c.fallback, c.primaryErr, err, ranSecondary, c.want, c.secondary)
+		}
+	}
+}
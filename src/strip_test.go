@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Records the products handlers pass to the store for writing
+type recordingStore struct {
+	*fakeStore
+	written []Product
+}
+
+func (s *recordingStore) Insert(p *Product) error {
+	s.written = append(s.written, *p)
+	return s.fakeStore.Insert(p)
+}
+
+func (s *recordingStore) InsertAll(products []Product) ([]error, error) {
+	s.written = append(s.written, products...)
+	return s.fakeStore.InsertAll(products)
+}
+
+func (s *recordingStore) Update(id bson.ObjectId, p *Product, expected int) error {
+	s.written = append(s.written, *p)
+	return s.fakeStore.Update(id, p, expected)
+}
+
+func TestServerFieldsIgnored(t *testing.T) {
+	store := &recordingStore{fakeStore: newFakeStore()}
+	existing := seed(store.fakeStore, "Lamp")[0]
+	spoofed := `"id": "` + bson.NewObjectId().Hex() + `", "number": 99, "views": 1000, "version": 7`
+
+	if w := serve(store, "POST", "/products", `{"name": "Desk", "price": 5, `+spoofed+`}`); w.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, want 201: %s", w.Code, w.Body)
+	}
+	if w := serveBulk(store, "strip", `[{"name": "Chair", "price": 5, `+spoofed+`}]`); w.Code != http.StatusCreated {
+		t.Fatalf("bulk: status = %d, want 201: %s", w.Code, w.Body)
+	}
+	w := serveWithHeaders(store, "PUT", "/products/"+existing.ID.Hex(), `{"name": "Lamp", "price": 5, `+spoofed+`}`,
+		map[string]string{"If-Match": "0"})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("update: status = %d, want 204: %s", w.Code, w.Body)
+	}
+
+	if len(store.written) != 3 {
+		t.Fatalf("%d products written, want 3", len(store.written))
+	}
+	for i, p := range store.written {
+		if p.ID != "" || p.Number != 0 || p.Views != 0 || p.Version != 0 {
+			t.Errorf("write %d passed the store client fields: id %q, number %d, views %d, version %d",
+				i, p.ID, p.Number, p.Views, p.Version)
+		}
+	}
+}
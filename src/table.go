@@ -0,0 +1,97 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Minimal paginated product table for browsing without a separate UI
+var productsTable = template.Must(template.New("products").Funcs(template.FuncMap{"unescaped": unescaped}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Products</title>
+</head>
+<body>
+<table>
+<thead>
+<tr><th>Id</th><th>Number</th><th>Name</th><th>Price</th><th>Discount</th></tr>
+</thead>
+<tbody>
+{{range .Products}}<tr><td><a href="/products/{{.ID.Hex}}">{{.ID.Hex}}</a></td><td>{{.Number}}</td><td>{{unescaped .Name}}</td><td>{{.Price}}</td><td>{{.Discount}}</td></tr>
+{{end}}</tbody>
+</table>
+<p>{{.From}}-{{.To}} of {{.Total}}</p>
+<p>{{if .Prev}}<a href="{{.Prev}}">Previous</a>{{end}} {{if .Next}}<a href="{{.Next}}">Next</a>{{end}}</p>
+</body>
+</html>
+`))
+
+// Undoes the escaping ESCAPE_HTML applies on write, as the template
+// escapes on output. Unescaping rather than trusting the stored name keeps
+// names stored before ESCAPE_HTML was turned on from injecting markup.
+func unescaped(s string) string {
+	if config.EscapeHTML {
+		return html.UnescapeString(s)
+	}
+	return s
+}
+
+// Reports whether the client's Accept header ranks HTML above JSON
+func prefersHTML(r *http.Request) bool {
+	for _, mediaType := range parseQualityList(r.Header.Get("Accept")) {
+		switch mediaType {
+		case "text/html":
+			return true
+		case "application/json", "application/*", "*/*":
+			return false
+		}
+	}
+	return false
+}
+
+// Returns the request URL with offset replaced, on the same snapshot
+func pageURL(r *http.Request, query *listQuery, offset int) string {
+	u := *r.URL
+	params := u.Query()
+	params.Set("offset", strconv.Itoa(offset))
+	// Stay on the snapshot the page was taken from
+	if query.snapshot != "" {
+		params.Set("snapshot", query.snapshot)
+	}
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// Writes products as an HTML table with links to the neighbouring pages
+func renderProductsTable(w http.ResponseWriter, r *http.Request, query *listQuery, products []Product, total int) {
+	page := struct {
+		Products        []Product
+		From, To, Total int
+		Prev, Next      string
+	}{Products: products, From: query.Skip + 1, To: query.Skip + len(products), Total: total}
+
+	if len(products) == 0 {
+		page.From = query.Skip
+	}
+	if query.Skip > 0 {
+		prev := query.Skip - query.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		page.Prev = pageURL(r, query, prev)
+	}
+	if query.Skip+len(products) < total {
+		page.Next = pageURL(r, query, query.Skip+query.Limit)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	err := productsTable.Execute(w, page)
+	if err != nil {
+		log.Println("Failed render products table: ", err)
+	}
+}
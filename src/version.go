@@ -0,0 +1,46 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Returns the API version the client declared, from the Api-Version header
+// or else a version parameter of the Accept media types, or "" if none
+func declaredVersion(r *http.Request) string {
+	if v := r.Header.Get("Api-Version"); v != "" {
+		return strings.TrimSpace(v)
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		_, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && params["version"] != "" {
+			return params["version"]
+		}
+	}
+	return ""
+}
+
+// Rejects requests declaring an API version not in config.APIVersions.
+// Requests declaring none get the latest, the last listed. The version
+// served is echoed in the Api-Version response header.
+func checkAPIVersion(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := declaredVersion(r)
+		if version == "" {
+			version = config.APIVersions[len(config.APIVersions)-1]
+		}
+
+		supported := false
+		for _, v := range config.APIVersions {
+			supported = supported || v == version
+		}
+		if !supported {
+			ErrorWithJSON(w, "Unsupported API version "+version+", use one of "+strings.Join(config.APIVersions, ", "), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Api-Version", version)
+		h.ServeHTTP(w, r)
+	})
+}
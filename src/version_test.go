@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAPIVersion(t *testing.T) {
+	defer func(old []string) { config.APIVersions = old }(config.APIVersions)
+	config.APIVersions = []string{"1", "2"}
+	store := newFakeStore()
+
+	cases := []struct {
+		headers map[string]string
+		status  int
+		served  string
+	}{
+		{nil, http.StatusOK, "2"},
+		{map[string]string{"Api-Version": "1"}, http.StatusOK, "1"},
+		{map[string]string{"Accept": "text/html, application/json; version=1"}, http.StatusOK, "1"},
+		{map[string]string{"Api-Version": "2", "Accept": "application/json; version=1"}, http.StatusOK, "2"},
+		{map[string]string{"Api-Version": "3"}, http.StatusBadRequest, ""},
+		{map[string]string{"Accept": "application/json; version=3"}, http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		w := serveWithHeaders(store, "GET", "/products", "", c.headers)
+		if w.Code != c.status || w.Header().Get("Api-Version") != c.served {
+			t.Errorf("%v: status %d serving version %q, want %d serving %q",
+				c.headers, w.Code, w.Header().Get("Api-Version"), c.status, c.served)
+		}
+	}
+}
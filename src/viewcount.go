@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Ways of counting product views, picked by VIEW_COUNTING
+const (
+	// Increment on every read
+	CountEvery = "every"
+	// Increment by the sample rate on one read in that many
+	CountSampled = "sampled"
+	// Count in memory and flush to Mongo periodically
+	CountBuffered = "buffered"
+)
+
+// View counts not yet flushed to Mongo, for buffered counting
+var pendingViews = struct {
+	sync.Mutex
+	counts map[bson.ObjectId]int
+}{counts: map[bson.ObjectId]int{}}
+
+// Records a view of the product with the given id, using the configured
+// counting strategy
+func countView(session *mgo.Session, id bson.ObjectId) {
+	inc := 1
+	switch config.ViewCounting {
+	case CountBuffered:
+		pendingViews.Lock()
+		pendingViews.counts[id]++
+		pendingViews.Unlock()
+		return
+	case CountSampled:
+		if rand.Intn(config.ViewSampleRate) != 0 {
+			return
+		}
+		inc = config.ViewSampleRate
+	}
+
+	// Unacknowledged, so counting doesn't wait on a round trip
+	session.SetSafe(nil)
+	c := session.DB(config.Database).C(config.Collection)
+	err := c.UpdateId(id, bson.M{"$inc": bson.M{"views": inc}})
+	if err != nil {
+		log.Println("Failed count product view: ", err)
+	}
+}
+
+// Writes the buffered view counts to Mongo
+func flushViews(s *mgo.Session) {
+	session := s.Copy()
+	defer session.Close()
+
+	c := session.DB(config.Database).C(config.Collection)
+	writeViews(func(id bson.ObjectId, n int) error {
+		return c.UpdateId(id, bson.M{"$inc": bson.M{"views": n}})
+	})
+}
+
+// Hands the buffered view counts to add. Counts that fail to be added are
+// kept for the next flush, except those of deleted products.
+func writeViews(add func(id bson.ObjectId, n int) error) {
+	pendingViews.Lock()
+	counts := pendingViews.counts
+	pendingViews.counts = map[bson.ObjectId]int{}
+	pendingViews.Unlock()
+
+	for id, n := range counts {
+		err := add(id, n)
+		if err != nil && err != mgo.ErrNotFound {
+			log.Println("Failed flush product views: ", err)
+			pendingViews.Lock()
+			pendingViews.counts[id] += n
+			pendingViews.Unlock()
+		}
+	}
+}
+
+// Calls flush every interval until stop is closed, then once more
+func flushViewsPeriodically(flush func(), interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			flush()
+		case <-stop:
+			flush()
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Views added by writeViews, by product
+type viewTotals struct {
+	sync.Mutex
+	views map[bson.ObjectId]int
+	// Errors the next adds fail with, in order
+	errs []error
+}
+
+func (v *viewTotals) add(id bson.ObjectId, n int) error {
+	v.Lock()
+	defer v.Unlock()
+
+	if len(v.errs) > 0 {
+		err := v.errs[0]
+		v.errs = v.errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	v.views[id] += n
+	return nil
+}
+
+func (v *viewTotals) of(id bson.ObjectId) int {
+	v.Lock()
+	defer v.Unlock()
+	return v.views[id]
+}
+
+func TestBufferedViewsAreFlushed(t *testing.T) {
+	defer func(counting string) { config.ViewCounting = counting }(config.ViewCounting)
+	config.ViewCounting = CountBuffered
+	id := bson.NewObjectId()
+	totals := &viewTotals{views: map[bson.ObjectId]int{}}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		flushViewsPeriodically(func() { writeViews(totals.add) }, time.Millisecond, stop)
+		close(stopped)
+	}()
+
+	for i := 0; i < 3; i++ {
+		countView(nil, id)
+	}
+	for deadline := time.Now().Add(time.Second); totals.of(id) < 3 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if views := totals.of(id); views != 3 {
+		t.Errorf("%d views flushed, want 3", views)
+	}
+
+	// Stopping flushes what is still buffered
+	countView(nil, id)
+	close(stop)
+	<-stopped
+	if views := totals.of(id); views != 4 {
+		t.Errorf("%d views flushed on stop, want 4", views)
+	}
+}
+
+func TestFailedViewFlushesAreRequeued(t *testing.T) {
+	defer func(counting string) { config.ViewCounting = counting }(config.ViewCounting)
+	config.ViewCounting = CountBuffered
+	id := bson.NewObjectId()
+	totals := &viewTotals{views: map[bson.ObjectId]int{}, errs: []error{fmt.Errorf("no primary")}}
+
+	countView(nil, id)
+	countView(nil, id)
+	writeViews(totals.add)
+	if views := totals.of(id); views != 0 {
+		t.Fatalf("%d views written by a failed flush", views)
+	}
+
+	countView(nil, id)
+	writeViews(totals.add)
+	if views := totals.of(id); views != 3 {
+		t.Errorf("%d views after the retry, want the 2 requeued and 1 new", views)
+	}
+
+	// Views of deleted products are dropped rather than retried forever
+	totals.errs = []error{mgo.ErrNotFound}
+	countView(nil, id)
+	writeViews(totals.add)
+	writeViews(totals.add)
+	if views := totals.of(id); views != 3 {
+		t.Errorf("%d views, want the view of the missing product dropped", views)
+	}
+}
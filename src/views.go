@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Stored fields each JSON field of a product is encoded from
+var storedFields = map[string][]string{
+	"id":          {"_id"},
+	"name":        {"name", "names"},
+	"names":       {"names"},
+	"price":       {"price"},
+	"discount":    {"discount"},
+	"final_price": {"price", "discount"},
+	"number":      {"number"},
+	"views":       {"views"},
+	"version":     {"version"},
+	"location":    {"location"},
+}
+
+// Returns an error naming the first of fields that isn't a product field
+func checkFields(fields []string) error {
+	for _, field := range fields {
+		if _, ok := storedFields[field]; !ok {
+			return fmt.Errorf("Unknown field %q", field)
+		}
+	}
+	return nil
+}
+
+// Returns the JSON fields selected by the request's fields or view param,
+// or nil for the full document
+func viewFields(r *http.Request) ([]string, error) {
+	params := r.URL.Query()
+	if v := params.Get("fields"); v != "" {
+		if params.Get("view") != "" {
+			return nil, fmt.Errorf("Use either fields or view")
+		}
+		fields := strings.Split(v, ",")
+		if err := checkFields(fields); err != nil {
+			return nil, err
+		}
+		return fields, nil
+	}
+
+	switch params.Get("view") {
+	case "", "full":
+		return nil, nil
+	case "mobile":
+		return config.MobileFields, nil
+	}
+	return nil, fmt.Errorf("View must be mobile or full")
+}
+
+// Reports whether a list request leaves the fields to the server, which
+// then returns summaries. ?full=true, ?view= and ?fields= opt out.
+func wantsSummary(r *http.Request) bool {
+	params := r.URL.Query()
+	return params.Get("full") != "true" && params.Get("view") == "" && params.Get("fields") == ""
+}
+
+// Returns the projection loading what the given JSON fields are encoded
+// from, or nil for the full document
+func projection(fields []string) bson.M {
+	if fields == nil {
+		return nil
+	}
+
+	selected := bson.M{}
+	for _, field := range fields {
+		for _, stored := range storedFields[field] {
+			selected[stored] = 1
+		}
+	}
+	return selected
+}
+
+// Encodes a product keeping only the given JSON fields
+func trimFields(p *Product, fields []string) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	trimmed := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if v, ok := all[field]; ok {
+			trimmed[field] = v
+		}
+	}
+	return trimmed, nil
+}
+
+// Encodes products as JSON, keeping only the given fields unless fields is
+// nil
+func marshalProducts(products []Product, fields []string) ([]byte, error) {
+	if fields == nil {
+		return json.MarshalIndent(products, "", "  ")
+	}
+
+	trimmed := make([]map[string]json.RawMessage, len(products))
+	for i := range products {
+		var err error
+		if trimmed[i], err = trimFields(&products[i], fields); err != nil {
+			return nil, err
+		}
+	}
+	return json.MarshalIndent(trimmed, "", "  ")
+}
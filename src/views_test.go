@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Returns the sorted keys of each listed product
+func listedKeys(t *testing.T, store ProductStore, url string) []string {
+	t.Helper()
+	var listed []map[string]json.RawMessage
+	w := serve(store, "GET", url, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("%s: body %s is not a list: %s", url, w.Body, err)
+	}
+
+	var keys []string
+	for _, p := range listed {
+		var fields []string
+		for field := range p {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		keys = append(keys, strings.Join(fields, ","))
+	}
+	return keys
+}
+
+func TestMobileView(t *testing.T) {
+	defer func(fields []string) { config.MobileFields = fields }(config.MobileFields)
+	config.MobileFields = []string{"id", "final_price"}
+	store := newFakeStore()
+	seed(store, "Lamp")
+
+	keys := listedKeys(t, store, "/products?view=mobile")
+	if len(keys) != 1 || keys[0] != "final_price,id" {
+		t.Errorf("view=mobile returned fields %v, want id and final_price", keys)
+	}
+}
+
+func TestCheckFields(t *testing.T) {
+	if err := checkFields([]string{"id", "name", "final_price"}); err != nil {
+		t.Errorf("known fields: %s", err)
+	}
+	if err := checkFields([]string{"id", "sku"}); err == nil || !strings.Contains(err.Error(), "sku") {
+		t.Errorf("unknown field: err = %v, want it named", err)
+	}
+}
+
+func TestIdsFetchWithFields(t *testing.T) {
+	store := newFakeStore()
+	products := seed(store, "Lamp", "Desk")
+
+	keys := listedKeys(t, store, "/products?ids="+idList(products, 1, 0)+"&fields=id,final_price")
+	if len(keys) != 2 || keys[0] != "final_price,id" || keys[1] != "final_price,id" {
+		t.Errorf("fields=id,final_price returned fields %v", keys)
+	}
+
+	var explained struct {
+		Projection map[string]int `json:"projection"`
+	}
+	decode(t, serve(store, "GET", "/products?ids="+idList(products, 0)+"&fields=id,final_price&explain=true", ""), &explained)
+	if len(explained.Projection) != 3 || explained.Projection["price"] != 1 || explained.Projection["discount"] != 1 || explained.Projection["_id"] != 1 {
+		t.Errorf("projection %v, want only what id and final_price are encoded from", explained.Projection)
+	}
+}